@@ -0,0 +1,414 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// registers are numbered like the x registers. x9, x10 and x17 hold
+// operands that are not in registers, x16 breaks cycles of parallel
+// moves and x17 carries values between two memory locations.
+const (
+	aarch64_X0  = 0
+	aarch64_X9  = 9
+	aarch64_X10 = 10
+	aarch64_X16 = 16
+	aarch64_X17 = 17
+	aarch64_FP  = 29
+	aarch64_LR  = 30
+)
+
+// aapcs64 passes the first eight arguments in x0 to x7 and the rest on
+// the stack, and returns the result in x0. preserve_most keeps every
+// register that the allocator hands out except x0.
+var aarch64CallingConvs = callingConvs{
+	"c": &CallingConv{
+		name:        "c",
+		argRegs:     []int{0, 1, 2, 3, 4, 5, 6, 7},
+		retReg:      aarch64_X0,
+		callerSaved: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 11, 12, 13, 14, 15},
+		calleeSaved: []int{19, 20, 21, 22, 23, 24, 25, 26, 27, 28},
+		stackAlign:  16,
+	},
+	"preserve_most": &CallingConv{
+		name:        "preserve_most",
+		argRegs:     []int{0, 1, 2, 3, 4, 5, 6, 7},
+		retReg:      aarch64_X0,
+		callerSaved: []int{0},
+		calleeSaved: []int{19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 1, 2, 3, 4, 5, 6, 7, 8, 11, 12, 13, 14, 15},
+		stackAlign:  16,
+	},
+}
+
+type aarch64Emitter struct {
+	w     io.Writer
+	mod   *Module
+	proc  *Procedure
+	conv  *CallingConv
+	alloc *allocation
+	// the frame below the saved fp and lr holds the outgoing stack
+	// arguments, then the spill slots, then the callee saved registers
+	outgoing  int
+	framesize int
+	labels    int
+}
+
+func (this *aarch64Emitter) emit(format string, args ...interface{}) {
+	fmt.Fprintf(this.w, "\t"+format+"\n", args...)
+}
+
+func (this *aarch64Emitter) label(blk *BasicBlock) string {
+	return fmt.Sprintf(".L%s_%s", this.proc.name, blk)
+}
+
+func (this *aarch64Emitter) newLabel() string {
+	this.labels += 1
+	return fmt.Sprintf(".L%s_%d", this.proc.name, this.labels)
+}
+
+func aarch64Reg(reg int) string {
+	return fmt.Sprintf("x%d", reg)
+}
+
+var (
+	aarch64Op_ADD    = &machineOpcode{name: "add", format: "add $d, $0, $1"}
+	aarch64Op_ADDI   = &machineOpcode{name: "addi", format: "add $d, $0, #$i"}
+	aarch64Op_ADDLSL = &machineOpcode{name: "addlsl", format: "add $d, $0, $1, lsl #$i", latency: 2}
+	aarch64Op_SUB    = &machineOpcode{name: "sub", format: "sub $d, $0, $1"}
+	aarch64Op_SUBI   = &machineOpcode{name: "subi", format: "sub $d, $0, #$i"}
+	aarch64Op_SUBLSL = &machineOpcode{name: "sublsl", format: "sub $d, $0, $1, lsl #$i", latency: 2}
+	aarch64Op_NEG    = &machineOpcode{name: "neg", format: "neg $d, $0"}
+	aarch64Op_MUL    = &machineOpcode{name: "mul", format: "mul $d, $0, $1", latency: 3}
+	aarch64Op_MADD   = &machineOpcode{name: "madd", format: "madd $d, $0, $1, $2", latency: 3}
+	aarch64Op_MSUB   = &machineOpcode{name: "msub", format: "msub $d, $0, $1, $2", latency: 3}
+	aarch64Op_MNEG   = &machineOpcode{name: "mneg", format: "mneg $d, $0, $1", latency: 3}
+	aarch64Op_LSL    = &machineOpcode{name: "lsl", format: "lsl $d, $0, $1"}
+	aarch64Op_LSLI   = &machineOpcode{name: "lsli", format: "lsl $d, $0, #$i"}
+	aarch64Op_MOVZ   = &machineOpcode{name: "movz", format: "movz $d, #$x"}
+	aarch64Op_MOVK16 = &machineOpcode{name: "movk16", format: "movk $d, #$x, lsl #16"}
+	aarch64Op_MOVK32 = &machineOpcode{name: "movk32", format: "movk $d, #$x, lsl #32"}
+	aarch64Op_MOVK48 = &machineOpcode{name: "movk48", format: "movk $d, #$x, lsl #48"}
+)
+
+// a step of loading a constant. the first step is a movz and the others
+// are movks that take the register as their source.
+type aarch64Step struct {
+	opcode *machineOpcode
+	imm    int64
+}
+
+// returns the steps that load a 64-bit constant, a movz followed by a
+// movk for every other nonzero halfword
+func aarch64Constant(value uint64) []aarch64Step {
+	steps := []aarch64Step{{aarch64Op_MOVZ, int64(value & 0xffff)}}
+	for i, movk := range []*machineOpcode{aarch64Op_MOVK16, aarch64Op_MOVK32, aarch64Op_MOVK48} {
+		if half := (value >> uint(16*(i+1))) & 0xffff; half != 0 {
+			steps = append(steps, aarch64Step{movk, int64(half)})
+		}
+	}
+	return steps
+}
+
+func isImm12Unsigned(value uint64) bool {
+	return value < 4096
+}
+
+func isNegImm12Unsigned(value uint64) bool {
+	return -value < 4096
+}
+
+// the multiply accumulate and shifted register forms cover an
+// instruction together with the multiplication or shift that defines
+// one of its operands, so they come before the tiles of one instruction
+var aarch64Rules = []iselRule{
+	{tree(opcode_MOV, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		for _, step := range aarch64Constant(sel.constant(args[0])) {
+			if step.opcode == aarch64Op_MOVZ {
+				sel.emit(step.opcode, dst, step.imm)
+			} else {
+				sel.emit(step.opcode, dst, step.imm, dst)
+			}
+		}
+	}},
+	{tree(opcode_ADD, leafReg, tree(opcode_MUL, leafReg, leafReg)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_MADD, dst, 0, args[1], args[2], args[0])
+	}},
+	{tree(opcode_ADD, tree(opcode_MUL, leafReg, leafReg), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_MADD, dst, 0, args[0], args[1], args[2])
+	}},
+	{tree(opcode_SUB, leafCon(isZero), tree(opcode_MUL, leafReg, leafReg)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_MNEG, dst, 0, args[1], args[2])
+	}},
+	{tree(opcode_SUB, leafReg, tree(opcode_MUL, leafReg, leafReg)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_MSUB, dst, 0, args[1], args[2], args[0])
+	}},
+	{tree(opcode_ADD, leafReg, tree(opcode_SHL, leafReg, leafCon(nil))), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADDLSL, dst, int64(sel.constant(args[2])&63), args[0], args[1])
+	}},
+	{tree(opcode_ADD, tree(opcode_SHL, leafReg, leafCon(nil)), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADDLSL, dst, int64(sel.constant(args[1])&63), args[2], args[0])
+	}},
+	{tree(opcode_SUB, leafReg, tree(opcode_SHL, leafReg, leafCon(nil))), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_SUBLSL, dst, int64(sel.constant(args[2])&63), args[0], args[1])
+	}},
+	{tree(opcode_SUB, leafCon(isZero), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_NEG, dst, 0, args[1])
+	}},
+	{tree(opcode_ADD, leafReg, leafCon(isImm12Unsigned)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADDI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_ADD, leafCon(isImm12Unsigned), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADDI, dst, int64(sel.constant(args[0])), args[1])
+	}},
+	{tree(opcode_ADD, leafReg, leafCon(isNegImm12Unsigned)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_SUBI, dst, -int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_SUB, leafReg, leafCon(isImm12Unsigned)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_SUBI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_SUB, leafReg, leafCon(isNegImm12Unsigned)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADDI, dst, -int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_SHL, leafReg, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_LSLI, dst, int64(sel.constant(args[1])&63), args[0])
+	}},
+	{tree(opcode_ADD, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_ADD, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SUB, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_SUB, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_MUL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_MUL, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SHL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(aarch64Op_LSL, dst, 0, args[0], args[1])
+	}},
+}
+
+// loads a 64-bit constant into reg
+func (this *aarch64Emitter) constant(reg int, value uint64) {
+	rd := aarch64Reg(reg)
+	for _, step := range aarch64Constant(value) {
+		this.emit("%s", step.opcode.text(rd, []string{rd}, step.imm))
+	}
+}
+
+// returns the frame offset of a spill slot or an incoming stack argument
+// and the base register it is relative to
+func (this *aarch64Emitter) address(loc location) string {
+	if loc.kind == location_ARG {
+		return fmt.Sprintf("[x29, #%d]", 16+8*loc.index)
+	} else {
+		return fmt.Sprintf("[sp, #%d]", this.outgoing+8*loc.index)
+	}
+}
+
+// returns a register that holds the value at loc, loading it into
+// scratch if it is not in a register
+func (this *aarch64Emitter) use(loc location, scratch int) int {
+	switch loc.kind {
+	case location_REG:
+		return loc.index
+	case location_CON:
+		this.constant(scratch, this.proc.constants[loc.index])
+	default:
+		this.emit("ldr %s, %s", aarch64Reg(scratch), this.address(loc))
+	}
+	return scratch
+}
+
+// returns the register to compute a value for loc into
+func (this *aarch64Emitter) def(loc location) int {
+	if loc.kind == location_REG {
+		return loc.index
+	}
+	return aarch64_X9
+}
+
+// stores the value computed into reg by def to loc
+func (this *aarch64Emitter) store(loc location, reg int) {
+	if loc.kind != location_REG && loc.kind != location_NONE {
+		this.emit("str %s, %s", aarch64Reg(reg), this.address(loc))
+	}
+}
+
+func (this *aarch64Emitter) move(dst, src location) {
+	if dst.kind == location_REG {
+		if src == dst {
+			return
+		} else if src.kind == location_REG {
+			this.emit("mov %s, %s", aarch64Reg(dst.index), aarch64Reg(src.index))
+		} else {
+			this.use(src, dst.index)
+		}
+	} else {
+		this.store(dst, this.use(src, aarch64_X17))
+	}
+}
+
+func (this *aarch64Emitter) moves(moves []move) {
+	for _, m := range sequentializeMoves(moves, regLocation(aarch64_X16)) {
+		this.move(m.dst, m.src)
+	}
+}
+
+func (this *aarch64Emitter) instruction(mi *machineInstr) {
+	switch mi.opcode {
+	case machine_MOV:
+		this.move(this.alloc.operand(mi.dst), this.alloc.operand(mi.srcs[0]))
+		return
+	case machine_CALL:
+		this.call(mi.ir)
+		return
+	}
+
+	scratch := []int{aarch64_X9, aarch64_X10, aarch64_X17}
+	var srcs []string
+	for i, src := range mi.srcs {
+		srcs = append(srcs, aarch64Reg(this.use(this.alloc.operand(src), scratch[i])))
+	}
+	dst := this.alloc.operand(mi.dst)
+	rd := this.def(dst)
+	this.emit("%s", mi.opcode.text(aarch64Reg(rd), srcs, mi.imm))
+	this.store(dst, rd)
+}
+
+func (this *aarch64Emitter) call(insr *Instruction) {
+	// stack arguments first, since the register moves may overwrite
+	// the registers that hold them
+	conv := aarch64CallingConvs.of(this.mod, insr.callee)
+	var moves []move
+	for i, arg := range insr.arguments {
+		src := this.alloc.operand(arg)
+		if i < len(conv.argRegs) {
+			moves = append(moves, move{regLocation(conv.argRegs[i]), src})
+		} else {
+			reg := this.use(src, aarch64_X17)
+			this.emit("str %s, [sp, #%d]", aarch64Reg(reg), 8*(i-len(conv.argRegs)))
+		}
+	}
+	this.moves(moves)
+
+	this.emit("bl %s", insr.callee)
+	this.move(this.alloc.operand(insr.operands[0]), regLocation(conv.retReg))
+}
+
+func (this *aarch64Emitter) prologue() {
+	this.emit("stp x29, x30, [sp, #-16]!")
+	this.emit("mov x29, sp")
+	if this.framesize > 0 {
+		if this.framesize < 4096 {
+			this.emit("sub sp, sp, #%d", this.framesize)
+		} else {
+			this.constant(aarch64_X16, uint64(this.framesize))
+			this.emit("sub sp, sp, x16")
+		}
+	}
+	for i, reg := range this.alloc.calleeSaved {
+		this.emit("str %s, [sp, #%d]", aarch64Reg(reg), this.outgoing+8*(this.alloc.nslots+i))
+	}
+
+	// move the arguments to the parameters of the entry point
+	var moves []move
+	params := this.proc.entryPoint.ssaparams
+	for i, src := range this.conv.parameters(len(params)) {
+		moves = append(moves, move{this.alloc.locations[params[i]], src})
+	}
+	this.moves(moves)
+}
+
+func (this *aarch64Emitter) epilogue() {
+	for i, reg := range this.alloc.calleeSaved {
+		this.emit("ldr %s, [sp, #%d]", aarch64Reg(reg), this.outgoing+8*(this.alloc.nslots+i))
+	}
+	this.emit("mov sp, x29")
+	this.emit("ldp x29, x30, [sp], #16")
+	this.emit("ret")
+}
+
+// emits the moves of the jump from blk to successor succidx followed
+// by a branch unless the successor is next
+func (this *aarch64Emitter) jump(blk *BasicBlock, succidx int, next *BasicBlock) {
+	this.moves(edgeMoves(this.proc, this.alloc, blk, succidx))
+	if succ := blk.successors[succidx]; succ != next {
+		this.emit("b %s", this.label(succ))
+	}
+}
+
+func (this *aarch64Emitter) terminator(blk *BasicBlock, next *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		this.move(regLocation(this.conv.retReg), this.alloc.operand(blk.jmpretval))
+		this.epilogue()
+	case opcode_JMP:
+		this.jump(blk, 0, next)
+	case opcode_JNZ:
+		rn := this.use(this.alloc.operand(blk.jmpretval), aarch64_X9)
+		if len(blk.successors[0].ssaparams) == 0 {
+			this.emit("cbnz %s, %s", aarch64Reg(rn), this.label(blk.successors[0]))
+			this.jump(blk, 1, next)
+		} else {
+			taken := this.newLabel()
+			this.emit("cbnz %s, %s", aarch64Reg(rn), taken)
+			this.jump(blk, 1, nil)
+			fmt.Fprintf(this.w, "%s:\n", taken)
+			this.jump(blk, 0, next)
+		}
+	}
+}
+
+func (this *aarch64Emitter) procedure() error {
+	if err := checkCodegen(this.proc); err != nil {
+		return err
+	}
+
+	order := codegenOrder(this.proc)
+	regs := aarch64CallingConvs.registers(this.mod, this.proc)
+	mp := selectInstructions(this.proc, order, aarch64Rules)
+	scheduleInstructions(mp, regs)
+	this.alloc = allocateRegisters(mp, regs)
+
+	this.conv = aarch64CallingConvs.of(this.mod, this.proc.name)
+	this.outgoing = aarch64CallingConvs.outgoing(this.mod, this.proc)
+	this.framesize = this.conv.align(this.outgoing + 8*(this.alloc.nslots+len(this.alloc.calleeSaved)))
+	if this.framesize > 32760 {
+		return errors.New(fmt.Sprintf("frame of procedure %s is too large", this.proc.name))
+	}
+
+	name := this.proc.name
+	fmt.Fprintf(this.w, "\t.globl %s\n", name)
+	fmt.Fprintf(this.w, "\t.type %s, %%function\n", name)
+	fmt.Fprintf(this.w, "\t.p2align 2\n")
+	fmt.Fprintf(this.w, "%s:\n", name)
+	this.prologue()
+
+	for i, mb := range mp.blocks {
+		var next *BasicBlock
+		if i+1 < len(order) {
+			next = order[i+1]
+		}
+
+		fmt.Fprintf(this.w, "%s:\n", this.label(mb.block))
+		for _, mi := range mb.instrs {
+			this.instruction(mi)
+		}
+		this.terminator(mb.block, next)
+	}
+
+	fmt.Fprintf(this.w, "\t.size %s, .-%s\n", name, name)
+	return nil
+}
+
+// emitAArch64 writes mod as gnu assembler source for aarch64 following
+// the aapcs64 calling convention. the procedures must be in ssa form.
+func emitAArch64(w io.Writer, mod *Module) error {
+	fmt.Fprintf(w, "\t.text\n")
+	for _, proc := range mod.procedures {
+		if err := (&aarch64Emitter{w: w, mod: mod, proc: proc}).procedure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
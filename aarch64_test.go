@@ -0,0 +1,106 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSequentializeMoves(t *testing.T) {
+	r := regLocation
+	scratch := r(16)
+
+	// a swap and a chain hanging off it
+	moves := []move{{r(0), r(1)}, {r(1), r(0)}, {r(2), r(0)}, {r(3), r(3)}}
+	regs := map[location]int{r(0): 0, r(1): 1, r(2): 2, r(3): 3}
+	for _, m := range sequentializeMoves(moves, scratch) {
+		if m.dst == m.src {
+			t.Fatal("redundant move", m)
+		}
+		regs[m.dst] = regs[m.src]
+	}
+
+	if regs[r(0)] != 1 || regs[r(1)] != 0 || regs[r(2)] != 0 || regs[r(3)] != 3 {
+		t.Fatal(regs)
+	}
+}
+
+func TestEmitAArch64(t *testing.T) {
+	source := `
+	func nine(a u64, b u64, c u64, d u64, e u64, f u64, g u64, h u64, i u64) u64 {
+		entry:
+			ret i
+	}
+
+	func big() u64 {
+		entry:
+			ret 0x1234000000005678
+	}
+
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, nine(0, 0, 0, 0, 0, 0, 0, 0, b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}`
+
+	var text string
+	err := Compile(&Config{
+		Source: source,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O1"); err != nil {
+				return err
+			}
+			var sb strings.Builder
+			err := emitAArch64(&sb, mod)
+			text = sb.String()
+			return err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"\t.globl pow\n",
+		", [x29, #16]\n",
+		"\tmovz x0, #0x5678\n\tmovk x0, #0x1234, lsl #48\n",
+		"\tstr x",
+		", [sp, #0]\n",
+		"\tbl nine\n",
+		"\tcbnz x",
+		"\tsub x",
+		"\tldp x29, x30, [sp], #16\n\tret\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Fatal(expected, text)
+		}
+	}
+}
+
+func TestEmitAArch64_NotSSA(t *testing.T) {
+	err := Compile(&Config{
+		Source: `
+		func f(x u64) u64 {
+			entry:
+				ret x
+		}`,
+		Module: func(mod *Module) error {
+			return emitAArch64(&strings.Builder{}, mod)
+		},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "ssa form") {
+		t.Fatal(err)
+	}
+}
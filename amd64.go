@@ -0,0 +1,617 @@
+package cube
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// registers are numbered like in the encoding. r10 and r11 hold operands
+// that are not in registers, r11 also breaks cycles of parallel moves
+// and r10 carries values between two memory locations. rcx is kept free
+// for the count of shifts by a register.
+const (
+	amd64_RAX = 0
+	amd64_RCX = 1
+	amd64_RDX = 2
+	amd64_RBX = 3
+	amd64_RSP = 4
+	amd64_RBP = 5
+	amd64_RSI = 6
+	amd64_RDI = 7
+	amd64_R8  = 8
+	amd64_R9  = 9
+	amd64_R10 = 10
+	amd64_R11 = 11
+)
+
+// the system v abi passes the first six arguments in registers and the
+// rest on the stack, and returns the result in rax. preserve_most keeps
+// every register that the allocator hands out except rax.
+var amd64CallingConvs = callingConvs{
+	"c": &CallingConv{
+		name:        "c",
+		argRegs:     []int{amd64_RDI, amd64_RSI, amd64_RDX, amd64_RCX, amd64_R8, amd64_R9},
+		retReg:      amd64_RAX,
+		callerSaved: []int{amd64_RDI, amd64_RSI, amd64_RDX, amd64_R8, amd64_R9, amd64_RAX},
+		calleeSaved: []int{amd64_RBX, 12, 13, 14, 15},
+		stackAlign:  16,
+	},
+	"preserve_most": &CallingConv{
+		name:        "preserve_most",
+		argRegs:     []int{amd64_RDI, amd64_RSI, amd64_RDX, amd64_RCX, amd64_R8, amd64_R9},
+		retReg:      amd64_RAX,
+		callerSaved: []int{amd64_RAX},
+		calleeSaved: []int{amd64_RBX, 12, 13, 14, 15, amd64_RDI, amd64_RSI, amd64_RDX, amd64_R8, amd64_R9},
+		stackAlign:  16,
+	},
+}
+
+// procedures encoded with a stack check compare rsp with the word at the
+// jit state symbol after reserving their frame and jump to the stack
+// overflow symbol if it is below. the jit defines both symbols.
+const (
+	amd64_JITSTATE      = "cube.jitstate"
+	amd64_STACKOVERFLOW = "cube.stackoverflow"
+)
+
+// objectCode is the machine code of a module. calls are encoded with a
+// zero displacement and listed as relocations for the linker or the jit
+// to resolve.
+type objectCode struct {
+	text        []byte
+	symbols     []objectSymbol
+	relocations []objectRelocation
+}
+
+// a symbol is a procedure at an offset of the text
+type objectSymbol struct {
+	name   string
+	offset int
+	size   int
+}
+
+// a relocation is a 32-bit displacement at offset relative to the end of
+// the displacement that must be patched to reach symbol
+type objectRelocation struct {
+	offset int
+	symbol string
+}
+
+func (this *objectCode) lookup(name string) *objectSymbol {
+	for i, _ := range this.symbols {
+		if this.symbols[i].name == name {
+			return &this.symbols[i]
+		}
+	}
+	return nil
+}
+
+// a jump whose displacement is patched when the procedure is done
+type amd64Fixup struct {
+	offset int
+	label  int
+}
+
+type amd64Emitter struct {
+	code  *objectCode
+	mod   *Module
+	proc  *Procedure
+	conv  *CallingConv
+	alloc *allocation
+	// the frame below the saved rbp holds the outgoing stack arguments,
+	// then the spill slots, then the callee saved registers
+	outgoing  int
+	framesize int
+	labels    []int
+	blocks    map[*BasicBlock]int
+	fixups    []amd64Fixup
+	// emit a stack check in every prologue
+	stackCheck bool
+}
+
+func (this *amd64Emitter) bytes(b ...byte) {
+	this.code.text = append(this.code.text, b...)
+}
+
+func (this *amd64Emitter) imm32(value int32) {
+	this.bytes(byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+func (this *amd64Emitter) newLabel() int {
+	this.labels = append(this.labels, -1)
+	return len(this.labels) - 1
+}
+
+func (this *amd64Emitter) bind(label int) {
+	this.labels[label] = len(this.code.text)
+}
+
+// emits a relocation of a 32-bit displacement to symbol
+func (this *amd64Emitter) relocation(symbol string) {
+	this.code.relocations = append(this.code.relocations, objectRelocation{len(this.code.text), symbol})
+	this.imm32(0)
+}
+
+// emits a jump with a 32-bit displacement to label
+func (this *amd64Emitter) jumpTo(label int, opcode ...byte) {
+	this.bytes(opcode...)
+	this.fixups = append(this.fixups, amd64Fixup{len(this.code.text), label})
+	this.imm32(0)
+}
+
+func fitsInt8(value int64) bool {
+	return value == int64(int8(value))
+}
+
+func fitsInt32(value int64) bool {
+	return value == int64(int32(value))
+}
+
+// emits a rex.w prefixed opcode with a register operand in modrm.reg
+// and a register operand in modrm.rm
+func (this *amd64Emitter) rr(reg, rm int, opcode ...byte) {
+	this.bytes(0x48 | byte(reg>>3)<<2 | byte(rm>>3))
+	this.bytes(opcode...)
+	this.bytes(0xc0 | byte(reg&7)<<3 | byte(rm&7))
+}
+
+// emits a rex.w prefixed opcode with a register operand or opcode
+// extension in modrm.reg and the memory operand [base+disp] in modrm.rm
+func (this *amd64Emitter) rm(reg, base int, disp int32, opcode ...byte) {
+	this.bytes(0x48 | byte(reg>>3)<<2 | byte(base>>3))
+	this.bytes(opcode...)
+
+	mod := byte(0x80)
+	if disp == 0 && base&7 != amd64_RBP {
+		mod = 0x00
+	} else if fitsInt8(int64(disp)) {
+		mod = 0x40
+	}
+
+	this.bytes(mod | byte(reg&7)<<3 | byte(base&7))
+	if base&7 == amd64_RSP {
+		this.bytes(0x24)
+	}
+
+	if mod == 0x40 {
+		this.bytes(byte(disp))
+	} else if mod == 0x80 {
+		this.imm32(disp)
+	}
+}
+
+// emits a rex.w prefixed opcode with a register operand in modrm.reg
+// and the rip relative memory operand [symbol] in modrm.rm
+func (this *amd64Emitter) ripRelative(reg int, symbol string, opcode ...byte) {
+	this.bytes(0x48 | byte(reg>>3)<<2)
+	this.bytes(opcode...)
+	this.bytes(0x05 | byte(reg&7)<<3)
+	this.relocation(symbol)
+}
+
+// loads a 64-bit constant with the shortest of mov r32, imm32 which zero
+// extends, mov r64, imm32 which sign extends and movabs
+func (this *amd64Emitter) constant(reg int, value uint64) {
+	if value <= 0xffffffff {
+		if reg >= 8 {
+			this.bytes(0x41)
+		}
+		this.bytes(0xb8 + byte(reg&7))
+		this.imm32(int32(value))
+	} else if fitsInt32(int64(value)) {
+		this.rr(0, reg, 0xc7)
+		this.imm32(int32(value))
+	} else {
+		this.bytes(0x48|byte(reg>>3), 0xb8+byte(reg&7))
+		this.imm32(int32(value))
+		this.imm32(int32(value >> 32))
+	}
+}
+
+// returns the base register and displacement of a spill slot or an
+// incoming stack argument
+func (this *amd64Emitter) address(loc location) (int, int32) {
+	if loc.kind == location_ARG {
+		return amd64_RBP, int32(16 + 8*loc.index)
+	} else {
+		return amd64_RSP, int32(this.outgoing + 8*loc.index)
+	}
+}
+
+func (this *amd64Emitter) load(reg int, loc location) {
+	base, disp := this.address(loc)
+	this.rm(reg, base, disp, 0x8b)
+}
+
+func (this *amd64Emitter) store(loc location, reg int) {
+	base, disp := this.address(loc)
+	this.rm(reg, base, disp, 0x89)
+}
+
+// returns a register that holds the value at loc, loading it into
+// scratch if it is not in a register
+func (this *amd64Emitter) use(loc location, scratch int) int {
+	switch loc.kind {
+	case location_REG:
+		return loc.index
+	case location_CON:
+		this.constant(scratch, this.proc.constants[loc.index])
+	default:
+		this.load(scratch, loc)
+	}
+	return scratch
+}
+
+func (this *amd64Emitter) mov(dst, src int) {
+	if dst != src {
+		this.rr(src, dst, 0x89)
+	}
+}
+
+func (this *amd64Emitter) move(dst, src location) {
+	if dst == src || dst.kind == location_NONE {
+		return
+	} else if dst.kind == location_REG {
+		if src.kind == location_REG {
+			this.mov(dst.index, src.index)
+		} else {
+			this.use(src, dst.index)
+		}
+	} else if src.kind == location_CON {
+		this.movImm(dst, this.proc.constants[src.index])
+	} else {
+		this.store(dst, this.use(src, amd64_R10))
+	}
+}
+
+// moves a constant to loc, directly with mov r/m64, imm32 if it fits
+func (this *amd64Emitter) movImm(loc location, value uint64) {
+	if loc.kind == location_NONE {
+		return
+	} else if loc.kind == location_REG {
+		this.constant(loc.index, value)
+	} else if fitsInt32(int64(value)) {
+		base, disp := this.address(loc)
+		this.rm(0, base, disp, 0xc7)
+		this.imm32(int32(value))
+	} else {
+		this.constant(amd64_R10, value)
+		this.store(loc, amd64_R10)
+	}
+}
+
+func (this *amd64Emitter) moves(moves []move) {
+	for _, m := range sequentializeMoves(moves, regLocation(amd64_R11)) {
+		this.move(m.dst, m.src)
+	}
+}
+
+// emits an add or sub of an immediate, which is opcode extension ext of
+// the immediate group 1 instructions
+func (this *amd64Emitter) group1(ext, reg int, imm int32) {
+	if fitsInt8(int64(imm)) {
+		this.rr(ext, reg, 0x83)
+		this.bytes(byte(imm))
+	} else {
+		this.rr(ext, reg, 0x81)
+		this.imm32(imm)
+	}
+}
+
+var (
+	amd64Op_ADD   = &machineOpcode{name: "add", format: "add $d, $0, $1"}
+	amd64Op_ADDI  = &machineOpcode{name: "addi", format: "add $d, $0, $i"}
+	amd64Op_SUB   = &machineOpcode{name: "sub", format: "sub $d, $0, $1"}
+	amd64Op_SUBI  = &machineOpcode{name: "subi", format: "sub $d, $0, $i"}
+	amd64Op_NEG   = &machineOpcode{name: "neg", format: "neg $d, $0"}
+	amd64Op_IMUL  = &machineOpcode{name: "imul", format: "imul $d, $0, $1", latency: 3}
+	amd64Op_IMULI = &machineOpcode{name: "imuli", format: "imul $d, $0, $i", latency: 3}
+	amd64Op_SHL   = &machineOpcode{name: "shl", format: "shl $d, $0, $1"}
+	amd64Op_SHLI  = &machineOpcode{name: "shli", format: "shl $d, $0, $i"}
+	amd64Op_LEA   = &machineOpcode{name: "lea", format: "lea $d, [$0+$1*$i]"}
+	amd64Op_MOVI  = &machineOpcode{name: "movi", format: "mov $d, $x"}
+)
+
+func isImm32(value uint64) bool {
+	return fitsInt32(int64(value))
+}
+
+// the shifts that the scale of the index of an address can do
+func isScale(value uint64) bool {
+	return value >= 1 && value <= 3
+}
+
+// the instructions have two operands, which the emitter turns into three
+// by moving the first operand to the destination first. lea adds a
+// shifted register without that move.
+var amd64Rules = []iselRule{
+	{tree(opcode_MOV, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_MOVI, dst, int64(sel.constant(args[0])))
+	}},
+	{tree(opcode_ADD, leafReg, tree(opcode_SHL, leafReg, leafCon(isScale))), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_LEA, dst, 1<<sel.constant(args[2]), args[0], args[1])
+	}},
+	{tree(opcode_ADD, tree(opcode_SHL, leafReg, leafCon(isScale)), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_LEA, dst, 1<<sel.constant(args[1]), args[2], args[0])
+	}},
+	{tree(opcode_ADD, leafReg, leafCon(isImm32)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_ADDI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_ADD, leafCon(isImm32), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_ADDI, dst, int64(sel.constant(args[0])), args[1])
+	}},
+	{tree(opcode_SUB, leafReg, leafCon(isImm32)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_SUBI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_SUB, leafCon(isZero), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_NEG, dst, 0, args[1])
+	}},
+	{tree(opcode_MUL, leafReg, leafCon(isImm32)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_IMULI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_MUL, leafCon(isImm32), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_IMULI, dst, int64(sel.constant(args[0])), args[1])
+	}},
+	{tree(opcode_SHL, leafReg, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_SHLI, dst, int64(sel.constant(args[1])&63), args[0])
+	}},
+	{tree(opcode_ADD, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_ADD, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SUB, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_SUB, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_MUL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_IMUL, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SHL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(amd64Op_SHL, dst, 0, args[0], args[1])
+	}},
+}
+
+// emits lea rd, [base+index*scale]
+func (this *amd64Emitter) lea(rd, base, index int, scale int64) {
+	this.bytes(0x48|byte(rd>>3)<<2|byte(index>>3)<<1|byte(base>>3), 0x8d)
+	ss := map[int64]byte{2: 1, 4: 2, 8: 3}[scale]
+	// rbp and r13 as base need a displacement
+	if base&7 == amd64_RBP {
+		this.bytes(0x44|byte(rd&7)<<3, ss<<6|byte(index&7)<<3|byte(base&7), 0)
+	} else {
+		this.bytes(0x04|byte(rd&7)<<3, ss<<6|byte(index&7)<<3|byte(base&7))
+	}
+}
+
+func (this *amd64Emitter) instruction(mi *machineInstr) {
+	dst := this.alloc.operand(mi.dst)
+
+	switch mi.opcode {
+	case machine_MOV:
+		this.move(dst, this.alloc.operand(mi.srcs[0]))
+		return
+	case machine_CALL:
+		this.call(mi.ir)
+		return
+	case amd64Op_MOVI:
+		this.movImm(dst, uint64(mi.imm))
+		return
+	}
+
+	rd := amd64_R10
+	if dst.kind == location_REG {
+		rd = dst.index
+	}
+
+	// the first operand is moved to the destination register first
+	// unless that would overwrite the second operand
+	rn := this.use(this.alloc.operand(mi.srcs[0]), amd64_R10)
+	switch mi.opcode {
+	case amd64Op_ADDI:
+		this.mov(rd, rn)
+		this.group1(0, rd, int32(mi.imm))
+	case amd64Op_SUBI:
+		this.mov(rd, rn)
+		this.group1(5, rd, int32(mi.imm))
+	case amd64Op_NEG:
+		this.mov(rd, rn)
+		this.rr(3, rd, 0xf7)
+	case amd64Op_IMULI:
+		if fitsInt8(mi.imm) {
+			this.rr(rd, rn, 0x6b)
+			this.bytes(byte(mi.imm))
+		} else {
+			this.rr(rd, rn, 0x69)
+			this.imm32(int32(mi.imm))
+		}
+	case amd64Op_SHLI:
+		this.mov(rd, rn)
+		this.rr(4, rd, 0xc1)
+		this.bytes(byte(mi.imm))
+	case amd64Op_SHL:
+		this.mov(amd64_RCX, this.use(this.alloc.operand(mi.srcs[1]), amd64_R11))
+		this.mov(rd, rn)
+		this.rr(4, rd, 0xd3)
+	case amd64Op_LEA:
+		this.lea(rd, rn, this.use(this.alloc.operand(mi.srcs[1]), amd64_R11), mi.imm)
+	default:
+		rm := this.use(this.alloc.operand(mi.srcs[1]), amd64_R11)
+		if rd == rm && rd != rn {
+			if mi.opcode == amd64Op_SUB {
+				rd = amd64_R11
+			} else {
+				rn, rm = rm, rn
+			}
+		}
+		this.mov(rd, rn)
+		switch mi.opcode {
+		case amd64Op_ADD:
+			this.rr(rm, rd, 0x01)
+		case amd64Op_SUB:
+			this.rr(rm, rd, 0x29)
+		case amd64Op_IMUL:
+			this.rr(rd, rm, 0x0f, 0xaf)
+		}
+	}
+
+	this.move(dst, regLocation(rd))
+}
+
+func (this *amd64Emitter) call(insr *Instruction) {
+	// stack arguments first, since the register moves may overwrite
+	// the registers that hold them
+	conv := amd64CallingConvs.of(this.mod, insr.callee)
+	var moves []move
+	for i, arg := range insr.arguments {
+		src := this.alloc.operand(arg)
+		if i < len(conv.argRegs) {
+			moves = append(moves, move{regLocation(conv.argRegs[i]), src})
+		} else {
+			reg := this.use(src, amd64_R10)
+			this.rm(reg, amd64_RSP, int32(8*(i-len(conv.argRegs))), 0x89)
+		}
+	}
+	this.moves(moves)
+
+	this.bytes(0xe8)
+	this.relocation(insr.callee)
+	this.move(this.alloc.operand(insr.operands[0]), regLocation(conv.retReg))
+}
+
+func (this *amd64Emitter) calleeSavedSlot(i int) int32 {
+	return int32(this.outgoing + 8*(this.alloc.nslots+i))
+}
+
+func (this *amd64Emitter) prologue() {
+	// push rbp, mov rbp, rsp, sub rsp, framesize
+	this.bytes(0x55)
+	this.rr(amd64_RSP, amd64_RBP, 0x89)
+	if this.framesize > 0 {
+		this.group1(5, amd64_RSP, int32(this.framesize))
+	}
+	if this.stackCheck {
+		// cmp rsp, [jitstate], jb stackoverflow
+		this.ripRelative(amd64_RSP, amd64_JITSTATE, 0x3b)
+		this.bytes(0x0f, 0x82)
+		this.relocation(amd64_STACKOVERFLOW)
+	}
+	for i, reg := range this.alloc.calleeSaved {
+		this.rm(reg, amd64_RSP, this.calleeSavedSlot(i), 0x89)
+	}
+
+	// move the arguments to the parameters of the entry point
+	var moves []move
+	params := this.proc.entryPoint.ssaparams
+	for i, src := range this.conv.parameters(len(params)) {
+		moves = append(moves, move{this.alloc.locations[params[i]], src})
+	}
+	this.moves(moves)
+}
+
+func (this *amd64Emitter) epilogue() {
+	for i, reg := range this.alloc.calleeSaved {
+		this.rm(reg, amd64_RSP, this.calleeSavedSlot(i), 0x8b)
+	}
+	// leave, ret
+	this.bytes(0xc9, 0xc3)
+}
+
+// emits the moves of the jump from blk to successor succidx followed
+// by a jump unless the successor is next
+func (this *amd64Emitter) jump(blk *BasicBlock, succidx int, next *BasicBlock) {
+	this.moves(edgeMoves(this.proc, this.alloc, blk, succidx))
+	if succ := blk.successors[succidx]; succ != next {
+		this.jumpTo(this.blocks[succ], 0xe9)
+	}
+}
+
+func (this *amd64Emitter) terminator(blk *BasicBlock, next *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		this.move(regLocation(this.conv.retReg), this.alloc.operand(blk.jmpretval))
+		this.epilogue()
+	case opcode_JMP:
+		this.jump(blk, 0, next)
+	case opcode_JNZ:
+		reg := this.use(this.alloc.operand(blk.jmpretval), amd64_R10)
+		this.rr(reg, reg, 0x85)
+		if len(blk.successors[0].ssaparams) == 0 {
+			this.jumpTo(this.blocks[blk.successors[0]], 0x0f, 0x85)
+			this.jump(blk, 1, next)
+		} else {
+			taken := this.newLabel()
+			this.jumpTo(taken, 0x0f, 0x85)
+			this.jump(blk, 1, nil)
+			this.bind(taken)
+			this.jump(blk, 0, next)
+		}
+	}
+}
+
+func (this *amd64Emitter) procedure() error {
+	if err := checkCodegen(this.proc); err != nil {
+		return err
+	}
+
+	order := codegenOrder(this.proc)
+	regs := amd64CallingConvs.registers(this.mod, this.proc)
+	mp := selectInstructions(this.proc, order, amd64Rules)
+	scheduleInstructions(mp, regs)
+	this.alloc = allocateRegisters(mp, regs)
+
+	this.conv = amd64CallingConvs.of(this.mod, this.proc.name)
+	this.outgoing = amd64CallingConvs.outgoing(this.mod, this.proc)
+	this.framesize = this.conv.align(this.outgoing + 8*(this.alloc.nslots+len(this.alloc.calleeSaved)))
+	if this.framesize > 1<<30 {
+		return errors.New(fmt.Sprintf("frame of procedure %s is too large", this.proc.name))
+	}
+
+	this.blocks = map[*BasicBlock]int{}
+	for _, blk := range order {
+		this.blocks[blk] = this.newLabel()
+	}
+
+	start := len(this.code.text)
+	this.prologue()
+
+	for i, mb := range mp.blocks {
+		var next *BasicBlock
+		if i+1 < len(order) {
+			next = order[i+1]
+		}
+
+		this.bind(this.blocks[mb.block])
+		for _, mi := range mb.instrs {
+			this.instruction(mi)
+		}
+		this.terminator(mb.block, next)
+	}
+
+	for _, fixup := range this.fixups {
+		disp := this.labels[fixup.label] - (fixup.offset + 4)
+		binary.LittleEndian.PutUint32(this.code.text[fixup.offset:], uint32(int32(disp)))
+	}
+
+	this.code.symbols = append(this.code.symbols, objectSymbol{
+		name:   this.proc.name,
+		offset: start,
+		size:   len(this.code.text) - start,
+	})
+	return nil
+}
+
+// encodeAMD64 translates mod to x86-64 machine code following the
+// system v calling convention. the procedures must be in ssa form.
+func encodeAMD64(mod *Module, stackCheck bool) (*objectCode, error) {
+	code := &objectCode{}
+	for _, proc := range mod.procedures {
+		emitter := &amd64Emitter{code: code, mod: mod, proc: proc, stackCheck: stackCheck}
+		if err := emitter.procedure(); err != nil {
+			return nil, err
+		}
+		// align procedures to 16 bytes with int3
+		for len(code.text)%16 != 0 {
+			code.text = append(code.text, 0xcc)
+		}
+	}
+	return code, nil
+}
@@ -0,0 +1,75 @@
+package cube
+
+import "math/bits"
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (this bitset) has(i int) bool {
+	return this[i/64]&(1<<(i%64)) != 0
+}
+
+func (this bitset) set(i int) {
+	this[i/64] |= 1 << (i % 64)
+}
+
+func (this bitset) clear(i int) {
+	this[i/64] &^= 1 << (i % 64)
+}
+
+func (this bitset) copy() bitset {
+	return append(bitset{}, this...)
+}
+
+func (this bitset) equal(other bitset) bool {
+	for i, word := range this {
+		if word != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// adds the bits of other and reports whether any were new
+func (this bitset) union(other bitset) bool {
+	changed := false
+	for i, word := range other {
+		changed = changed || this[i]|word != this[i]
+		this[i] |= word
+	}
+	return changed
+}
+
+func (this bitset) intersect(other bitset) {
+	for i, word := range other {
+		this[i] &= word
+	}
+}
+
+func (this bitset) difference(other bitset) {
+	for i, word := range other {
+		this[i] &^= word
+	}
+}
+
+func (this bitset) count() int {
+	n := 0
+	for _, word := range this {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// calls fn with the index of every set bit in ascending order
+func (this bitset) each(fn func(i int)) {
+	for i, word := range this {
+		for word != 0 {
+			j := bits.TrailingZeros64(word)
+			fn(i*64 + j)
+			word &^= 1 << j
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package cube
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// the bytecode is a sequence of 32-bit words. the first word of an
+// instruction holds the opcode in its lowest byte and the first operand,
+// a slot or an argument index, in the upper bytes. the following words
+// hold slots, jump targets, procedure indices or 64-bit immediates split
+// into a low and a high word.
+type bytecodeOpcode uint8
+
+const (
+	bytecode_MOV  bytecodeOpcode = iota // d, s
+	bytecode_MOVI                       // d, imm
+	bytecode_ADD                        // d, a, b
+	bytecode_ADDI                       // d, a, imm
+	bytecode_SUB                        // d, a, b
+	bytecode_SUBI                       // d, a, imm
+	bytecode_MUL                        // d, a, b
+	bytecode_MULI                       // d, a, imm
+	bytecode_SHL                        // d, a, b
+	bytecode_SHLI                       // d, a, imm
+	bytecode_ARG                        // k, s
+	bytecode_ARGI                       // k, imm
+	bytecode_CALL                       // d, proc
+	bytecode_JMP                        // -, target
+	bytecode_JNZ                        // s, target
+	bytecode_RET                        // s
+	bytecode_RETI                       // -, imm
+	bytecodeOpcodes
+)
+
+// the number of words of every instruction
+var bytecodeLengths = [bytecodeOpcodes]int{
+	bytecode_MOV:  2,
+	bytecode_MOVI: 3,
+	bytecode_ADD:  3,
+	bytecode_ADDI: 4,
+	bytecode_SUB:  3,
+	bytecode_SUBI: 4,
+	bytecode_MUL:  3,
+	bytecode_MULI: 4,
+	bytecode_SHL:  3,
+	bytecode_SHLI: 4,
+	bytecode_ARG:  2,
+	bytecode_ARGI: 3,
+	bytecode_CALL: 2,
+	bytecode_JMP:  2,
+	bytecode_JNZ:  2,
+	bytecode_RET:  1,
+	bytecode_RETI: 3,
+}
+
+// the register and immediate forms of the binary instructions
+var bytecodeBinary = map[*opcode][2]bytecodeOpcode{
+	opcode_ADD: {bytecode_ADD, bytecode_ADDI},
+	opcode_SUB: {bytecode_SUB, bytecode_SUBI},
+	opcode_MUL: {bytecode_MUL, bytecode_MULI},
+	opcode_SHL: {bytecode_SHL, bytecode_SHLI},
+}
+
+// the most slots that the frame and the outgoing slots of a procedure
+// may have together
+const bytecodeMaxFrame = 1 << 16
+
+// a procedure owns the words of the code from its offset up to the
+// offset of the next procedure. its frame holds framesize slots with the
+// parameters in the first ones, followed by outgoing slots in which the
+// arguments of calls are passed as the parameters of the callee.
+type bytecodeProc struct {
+	name      string
+	nparams   int
+	framesize int
+	outgoing  int
+	offset    int
+}
+
+// Bytecode is a module compiled for the VM
+type Bytecode struct {
+	procs []bytecodeProc
+	code  []uint32
+}
+
+func (this *Bytecode) lookup(name string) int {
+	for i, proc := range this.procs {
+		if proc.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+type bytecodeCompiler struct {
+	bc      *Bytecode
+	proc    *Procedure
+	alloc   *allocation
+	scratch int
+	labels  map[*BasicBlock]int
+	fixups  map[int]*BasicBlock
+}
+
+func (this *bytecodeCompiler) emit(op bytecodeOpcode, a int, words ...uint32) {
+	this.bc.code = append(this.bc.code, uint32(op)|uint32(a)<<8)
+	this.bc.code = append(this.bc.code, words...)
+}
+
+func bytecodeImmediate(value uint64) []uint32 {
+	return []uint32{uint32(value), uint32(value >> 32)}
+}
+
+// returns the slot of loc, loading a constant into the scratch slot
+func (this *bytecodeCompiler) slot(loc location) int {
+	if loc.kind == location_CON {
+		this.emit(bytecode_MOVI, this.scratch, bytecodeImmediate(this.proc.constants[loc.index])...)
+		return this.scratch
+	}
+	return loc.index
+}
+
+// returns the slot to write a value for loc to. unused values are
+// written to the scratch slot.
+func (this *bytecodeCompiler) def(loc location) int {
+	if loc.kind == location_NONE {
+		return this.scratch
+	}
+	return loc.index
+}
+
+func (this *bytecodeCompiler) move(dst, src location) {
+	if dst == src || dst.kind == location_NONE {
+		return
+	} else if src.kind == location_CON {
+		this.emit(bytecode_MOVI, dst.index, bytecodeImmediate(this.proc.constants[src.index])...)
+	} else {
+		this.emit(bytecode_MOV, dst.index, uint32(src.index))
+	}
+}
+
+func (this *bytecodeCompiler) moves(moves []move) {
+	for _, m := range sequentializeMoves(moves, regLocation(this.scratch)) {
+		this.move(m.dst, m.src)
+	}
+}
+
+func (this *bytecodeCompiler) instruction(insr *Instruction) {
+	dst := this.alloc.operand(insr.operands[0])
+
+	switch insr.opcode {
+	case opcode_MOV:
+		this.move(dst, this.alloc.operand(insr.operands[1]))
+		return
+	case opcode_CALL:
+		for i, arg := range insr.arguments {
+			if src := this.alloc.operand(arg); src.kind == location_CON {
+				this.emit(bytecode_ARGI, i, bytecodeImmediate(this.proc.constants[src.index])...)
+			} else {
+				this.emit(bytecode_ARG, i, uint32(src.index))
+			}
+		}
+		this.emit(bytecode_CALL, this.def(dst), uint32(this.bc.lookup(insr.callee)))
+		return
+	}
+
+	a := this.alloc.operand(insr.operands[1])
+	b := this.alloc.operand(insr.operands[2])
+	if a.kind == location_CON && b.kind != location_CON && (insr.opcode == opcode_ADD || insr.opcode == opcode_MUL) {
+		a, b = b, a
+	}
+
+	forms := bytecodeBinary[insr.opcode]
+	if b.kind == location_CON {
+		this.emit(forms[1], this.def(dst), append([]uint32{uint32(this.slot(a))}, bytecodeImmediate(this.proc.constants[b.index])...)...)
+	} else {
+		this.emit(forms[0], this.def(dst), uint32(this.slot(a)), uint32(b.index))
+	}
+}
+
+// emits the moves of the jump from blk to successor succidx followed
+// by a jump unless the successor is next
+func (this *bytecodeCompiler) jump(blk *BasicBlock, succidx int, next *BasicBlock) {
+	this.moves(edgeMoves(this.proc, this.alloc, blk, succidx))
+	if succ := blk.successors[succidx]; succ != next {
+		this.emit(bytecode_JMP, 0, 0)
+		this.fixups[len(this.bc.code)-1] = succ
+	}
+}
+
+func (this *bytecodeCompiler) terminator(blk *BasicBlock, next *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		if src := this.alloc.operand(blk.jmpretval); src.kind == location_CON {
+			this.emit(bytecode_RETI, 0, bytecodeImmediate(this.proc.constants[src.index])...)
+		} else {
+			this.emit(bytecode_RET, src.index)
+		}
+	case opcode_JMP:
+		this.jump(blk, 0, next)
+	case opcode_JNZ:
+		cond := this.slot(this.alloc.operand(blk.jmpretval))
+		if len(blk.successors[0].ssaparams) == 0 {
+			this.emit(bytecode_JNZ, cond, 0)
+			this.fixups[len(this.bc.code)-1] = blk.successors[0]
+			this.jump(blk, 1, next)
+		} else {
+			this.emit(bytecode_JNZ, cond, 0)
+			taken := len(this.bc.code) - 1
+			this.jump(blk, 1, nil)
+			this.bc.code[taken] = uint32(len(this.bc.code))
+			this.jump(blk, 0, next)
+		}
+	}
+}
+
+func (this *bytecodeCompiler) procedure(index int) error {
+	if err := checkCodegen(this.proc); err != nil {
+		return err
+	}
+
+	// every slot is preserved across calls, so the allocator maps the ssa
+	// registers to as few slots as possible without ever spilling
+	order := codegenOrder(this.proc)
+	regs := &registerSet{}
+	for i := 0; i < len(this.proc.ssaregs); i++ {
+		regs.calleeSaved = append(regs.calleeSaved, i)
+	}
+	this.alloc = allocateRegisters(lowerIR(this.proc, order), regs)
+
+	nparams := len(this.proc.entryPoint.ssaparams)
+	this.scratch = nparams
+	outgoing := 0
+	for _, loc := range this.alloc.locations {
+		if loc.kind == location_REG && loc.index >= this.scratch {
+			this.scratch = loc.index + 1
+		}
+	}
+	for _, blk := range order {
+		for _, insr := range blk.instructions {
+			if insr.opcode == opcode_CALL && len(insr.arguments) > outgoing {
+				outgoing = len(insr.arguments)
+			}
+		}
+	}
+
+	if this.scratch+1+outgoing > bytecodeMaxFrame {
+		return errors.New(fmt.Sprintf("frame of procedure %s is too large", this.proc.name))
+	}
+
+	this.bc.procs[index] = bytecodeProc{
+		name:      this.proc.name,
+		nparams:   nparams,
+		framesize: this.scratch + 1,
+		outgoing:  outgoing,
+		offset:    len(this.bc.code),
+	}
+
+	// the arguments arrive in the first slots
+	var moves []move
+	for i, val := range this.proc.entryPoint.ssaparams {
+		moves = append(moves, move{this.alloc.locations[val], regLocation(i)})
+	}
+	this.moves(moves)
+
+	this.labels = map[*BasicBlock]int{}
+	this.fixups = map[int]*BasicBlock{}
+	for i, blk := range order {
+		var next *BasicBlock
+		if i+1 < len(order) {
+			next = order[i+1]
+		}
+
+		this.labels[blk] = len(this.bc.code)
+		for j, _ := range blk.instructions {
+			this.instruction(&blk.instructions[j])
+		}
+		this.terminator(blk, next)
+	}
+
+	for offset, blk := range this.fixups {
+		this.bc.code[offset] = uint32(this.labels[blk])
+	}
+	return nil
+}
+
+// CompileBytecode compiles the procedures of mod, which must be in ssa
+// form, to bytecode for the VM
+func CompileBytecode(mod *Module) (*Bytecode, error) {
+	bc := &Bytecode{}
+	for _, proc := range mod.procedures {
+		bc.procs = append(bc.procs, bytecodeProc{name: proc.name})
+	}
+
+	for i, proc := range mod.procedures {
+		if err := (&bytecodeCompiler{bc: bc, proc: proc}).procedure(i); err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// the serialized bytecode starts with this magic followed by a version
+const bytecodeMagic = "cubebc\x00"
+const bytecodeVersion = 1
+
+// ErrNotBytecode is returned by ReadBytecode if the input does not start
+// with the magic of serialized bytecode
+var ErrNotBytecode = errors.New("not cube bytecode")
+
+// WriteTo serializes the bytecode. every number but the words of the
+// code is written as an unsigned varint.
+func (this *Bytecode) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	varint := func(value int) {
+		var tmp [binary.MaxVarintLen64]byte
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], uint64(value))])
+	}
+
+	buf.WriteString(bytecodeMagic)
+	varint(bytecodeVersion)
+	varint(len(this.procs))
+	for _, proc := range this.procs {
+		varint(len(proc.name))
+		buf.WriteString(proc.name)
+		varint(proc.nparams)
+		varint(proc.framesize)
+		varint(proc.outgoing)
+		varint(proc.offset)
+	}
+	varint(len(this.code))
+	binary.Write(&buf, binary.LittleEndian, this.code)
+
+	return buf.WriteTo(w)
+}
+
+// ReadBytecode reads bytecode written by Bytecode.WriteTo and verifies
+// that it cannot make the VM access anything outside of its frames
+func ReadBytecode(r io.Reader) (*Bytecode, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	} else if !bytes.HasPrefix(data, []byte(bytecodeMagic)) {
+		return nil, ErrNotBytecode
+	}
+	data = data[len(bytecodeMagic):]
+
+	var failed bool
+	varint := func() int {
+		value, n := binary.Uvarint(data)
+		if n <= 0 || value > 1<<31 {
+			failed = true
+			return 0
+		}
+		data = data[n:]
+		return int(value)
+	}
+
+	if version := varint(); version != bytecodeVersion {
+		return nil, errors.New(fmt.Sprintf("unsupported bytecode version %d", version))
+	}
+
+	bc := &Bytecode{}
+	nprocs := varint()
+	for i := 0; i < nprocs && !failed; i++ {
+		var proc bytecodeProc
+		if n := varint(); n <= len(data) {
+			proc.name = string(data[:n])
+			data = data[n:]
+		} else {
+			failed = true
+		}
+		proc.nparams = varint()
+		proc.framesize = varint()
+		proc.outgoing = varint()
+		proc.offset = varint()
+		bc.procs = append(bc.procs, proc)
+	}
+
+	if ncode := varint(); failed || ncode*4 != len(data) {
+		return nil, errors.New("truncated bytecode")
+	} else {
+		bc.code = make([]uint32, ncode)
+		binary.Read(bytes.NewReader(data), binary.LittleEndian, bc.code)
+	}
+
+	if err := bc.verify(); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// checks that every procedure has a frame of at most bytecodeMaxFrame
+// slots and ends with a jump or a return, and that every operand refers
+// to a slot of its frame, an outgoing slot, an instruction of the same
+// procedure or a procedure
+func (this *Bytecode) verify() error {
+	for i, proc := range this.procs {
+		end := len(this.code)
+		if i+1 < len(this.procs) {
+			end = this.procs[i+1].offset
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return errors.New(fmt.Sprintf("invalid bytecode in procedure %s: ", proc.name) + fmt.Sprintf(format, args...))
+		}
+
+		if proc.offset > end || proc.nparams >= proc.framesize || proc.framesize+proc.outgoing > bytecodeMaxFrame {
+			return fail("bad header")
+		}
+
+		starts := map[int]bool{}
+		var targets []int
+		var last bytecodeOpcode
+		for pc := proc.offset; pc < end; {
+			op, a := bytecodeOpcode(this.code[pc]&0xff), int(this.code[pc]>>8)
+			if op >= bytecodeOpcodes || pc+bytecodeLengths[op] > end {
+				return fail("bad instruction at %d", pc)
+			}
+			starts[pc] = true
+			last = op
+
+			slots := []int{}
+			switch op {
+			case bytecode_MOV, bytecode_ADDI, bytecode_SUBI, bytecode_MULI, bytecode_SHLI:
+				slots = append(slots, a, int(this.code[pc+1]))
+			case bytecode_ADD, bytecode_SUB, bytecode_MUL, bytecode_SHL:
+				slots = append(slots, a, int(this.code[pc+1]), int(this.code[pc+2]))
+			case bytecode_MOVI, bytecode_JNZ, bytecode_RET:
+				slots = append(slots, a)
+			case bytecode_ARG, bytecode_ARGI:
+				if a >= proc.outgoing {
+					return fail("bad argument at %d", pc)
+				} else if op == bytecode_ARG {
+					slots = append(slots, int(this.code[pc+1]))
+				}
+			case bytecode_CALL:
+				if callee := int(this.code[pc+1]); callee >= len(this.procs) || this.procs[callee].nparams > proc.outgoing {
+					return fail("bad call at %d", pc)
+				}
+				slots = append(slots, a)
+			}
+
+			if op == bytecode_JMP || op == bytecode_JNZ {
+				targets = append(targets, int(this.code[pc+1]))
+			}
+
+			for _, slot := range slots {
+				if slot >= proc.framesize {
+					return fail("bad slot at %d", pc)
+				}
+			}
+			pc += bytecodeLengths[op]
+		}
+
+		if last != bytecode_JMP && last != bytecode_RET && last != bytecode_RETI {
+			return fail("missing terminator")
+		}
+
+		for _, target := range targets {
+			if !starts[target] {
+				return fail("bad jump target %d", target)
+			}
+		}
+	}
+	return nil
+}
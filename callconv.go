@@ -0,0 +1,125 @@
+package cube
+
+// the convention of procedures that are not annotated with one, which is
+// the c convention of the platform
+const callconv_DEFAULT = "c"
+
+// the conventions that a procedure can be annotated with in cubeasm.
+// preserve_most changes only the return register and the argument
+// registers, which suits procedures that are called rarely from code
+// that keeps many values in registers.
+var callingConvNames = []string{callconv_DEFAULT, "preserve_most"}
+
+func isCallingConv(name string) bool {
+	for _, conv := range callingConvNames {
+		if conv == name {
+			return true
+		}
+	}
+	return false
+}
+
+// a CallingConv describes how the procedures of a target pass arguments
+// and results and which registers survive a call
+type CallingConv struct {
+	name string
+	// the registers that pass the first arguments. the others are passed
+	// in 8 byte slots at the bottom of the frame of the caller, the first
+	// at the lowest address.
+	argRegs []int
+	retReg  int
+	// the registers that a call may change and those that it preserves,
+	// which together are the registers that the allocator hands out
+	callerSaved []int
+	calleeSaved []int
+	// the alignment of the stack pointer in bytes at a call
+	stackAlign int
+}
+
+func (this *CallingConv) Name() string {
+	return this.name
+}
+
+// returns the number of bytes of arguments that a call with nargs
+// arguments passes on the stack
+func (this *CallingConv) stackArgs(nargs int) int {
+	if nargs > len(this.argRegs) {
+		return 8 * (nargs - len(this.argRegs))
+	}
+	return 0
+}
+
+// returns size rounded up to the stack alignment
+func (this *CallingConv) align(size int) int {
+	return (size + this.stackAlign - 1) &^ (this.stackAlign - 1)
+}
+
+// returns the registers that a call with nargs arguments to a procedure
+// of this convention may change, which are its caller saved registers and
+// the argument registers that the caller writes
+func (this *CallingConv) clobbers(nargs int) []int {
+	clobbers := append([]int{}, this.callerSaved...)
+	for i, reg := range this.argRegs {
+		if i < nargs {
+			clobbers = append(clobbers, reg)
+		}
+	}
+	return append(clobbers, this.retReg)
+}
+
+// the calling conventions of a target by the names that procedures are
+// annotated with
+type callingConvs map[string]*CallingConv
+
+// returns the convention of the procedure called name. procedures outside
+// of mod follow the default.
+func (this callingConvs) of(mod *Module, name string) *CallingConv {
+	if proc := mod.lookup(name); proc != nil && proc.callconv != "" {
+		return this[proc.callconv]
+	}
+	return this[callconv_DEFAULT]
+}
+
+// returns the registers that proc hands to the allocator. its calls
+// change the registers of the conventions of their callees.
+func (this callingConvs) registers(mod *Module, proc *Procedure) *registerSet {
+	conv := this.of(mod, proc.name)
+	return &registerSet{
+		callerSaved: conv.callerSaved,
+		calleeSaved: conv.calleeSaved,
+		clobbers: func(call *Instruction) []int {
+			return this.of(mod, call.callee).clobbers(len(call.arguments))
+		},
+	}
+}
+
+// returns the number of bytes that the calls of proc pass on the stack
+// at most
+func (this callingConvs) outgoing(mod *Module, proc *Procedure) int {
+	outgoing := 0
+	for _, blk := range proc.blocks {
+		for _, insr := range blk.instructions {
+			if insr.opcode != opcode_CALL {
+				continue
+			} else if n := this.of(mod, insr.callee).stackArgs(len(insr.arguments)); n > outgoing {
+				outgoing = n
+			}
+		}
+	}
+	return outgoing
+}
+
+// returns the locations of the arguments of a procedure of conv when it
+// is entered, registers for the first and incoming stack slots for the
+// rest
+func (this *CallingConv) parameters(nparams int) []location {
+	var locs []location
+	for i := 0; i < nparams; i++ {
+		if i < len(this.argRegs) {
+			locs = append(locs, regLocation(this.argRegs[i]))
+		} else {
+			locs = append(locs, location{location_ARG, i - len(this.argRegs)})
+		}
+	}
+	return locs
+}
@@ -0,0 +1,108 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse_CallingConv(t *testing.T) {
+	source := `
+	func f(a u64) u64 preserve_most {
+		entry:
+			ret a
+	}`
+
+	var text string
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			if proc.CallingConv() != "preserve_most" {
+				t.Fatal(proc.CallingConv())
+			}
+			var sb strings.Builder
+			printproc(&sb, proc)
+			text = sb.String()
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(text, "func f(a u64) u64 preserve_most {\n") {
+		t.Fatal(text)
+	}
+
+	err = Compile(&Config{
+		Filename: "test.cubeasm",
+		Source: `
+		func f() u64 fastcall {
+			entry:
+				ret 0
+		}`,
+	})
+
+	if diags, ok := err.(Diagnostics); !ok || len(diags) != 1 {
+		t.Fatal(err)
+	} else if diags[0].Code != diag_CALLCONV || diags[0].Error() != "test.cubeasm:2: unknown calling convention fastcall" {
+		t.Fatal(diags[0])
+	}
+}
+
+func TestCallingConv_PreserveMost(t *testing.T) {
+	source := `
+	func f(x u64) u64 {
+		var y u64
+		entry:
+			call y, g(x)
+			add y, y, x
+			ret y
+	}
+
+	func g(x u64) u64 preserve_most {
+		var y u64
+		entry:
+			call y, h(x)
+			ret y
+	}
+
+	func h(x u64) u64 {
+		entry:
+			ret x
+	}`
+
+	procs := map[string]string{}
+	err := Compile(&Config{
+		Source: source,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O1"); err != nil {
+				return err
+			}
+			var sb strings.Builder
+			err := emitAArch64(&sb, mod)
+			for _, text := range strings.Split(sb.String(), "\t.globl ")[1:] {
+				procs[text[:strings.Index(text, "\n")]] = text
+			}
+			return err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// x stays in a register that g preserves without a save in f
+	if strings.Contains(procs["f"], "str x") {
+		t.Fatal(procs["f"])
+	}
+
+	// g saves the registers of the c convention that h may change
+	for _, expected := range []string{"str x1,", "str x8,", "str x15,", "ldr x1,", "\tbl h\n"} {
+		if !strings.Contains(procs["g"], expected) {
+			t.Fatal(expected, procs["g"])
+		}
+	}
+	if strings.Contains(procs["g"], "str x0,") {
+		t.Fatal(procs["g"])
+	}
+}
@@ -46,6 +46,7 @@ func topologicalSort(blocks []*BasicBlock) []*BasicBlock {
 	var result []*BasicBlock
 
 	index := 0
+	sccomponent := 0
 	onstack := map[*BasicBlock]struct{}{}
 	lowlinks := map[*BasicBlock]int{}
 	indices := map[*BasicBlock]int{}
@@ -73,7 +74,6 @@ func topologicalSort(blocks []*BasicBlock) []*BasicBlock {
 			}
 		}
 
-		sccomponent := 0
 		if lowlinks[blk] == indices[blk] {
 			var item *BasicBlock
 			end := len(stack)
@@ -108,3 +108,59 @@ func Pass_BuildCFG(proc *Procedure) *Procedure {
 	proc.blocks = topologicalSort(blks2)
 	return proc
 }
+
+// finds the reachable blocks from which no ret can be reached that are
+// entered from the entry point or from a block that can still return
+func nonReturningBlocks(proc *Procedure) []*BasicBlock {
+	blocks := predecessors(reachable(proc.entryPoint, proc.blocks))
+
+	returns := map[*BasicBlock]struct{}{}
+	var recurse func(*BasicBlock)
+	recurse = func(blk *BasicBlock) {
+		if _, visited := returns[blk]; !visited {
+			returns[blk] = struct{}{}
+			for _, pred := range blk.predecessors {
+				recurse(pred)
+			}
+		}
+	}
+
+	for _, blk := range blocks {
+		if blk.jmpcode == opcode_RET {
+			recurse(blk)
+		}
+	}
+
+	var result []*BasicBlock
+	for _, blk := range blocks {
+		if _, ok := returns[blk]; ok {
+			continue
+		} else if blk == proc.entryPoint {
+			return []*BasicBlock{blk}
+		}
+		for _, pred := range blk.predecessors {
+			if _, ok := returns[pred]; ok {
+				result = append(result, blk)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+// puts a fresh block in front of the entry point that jumps to it, so
+// that the old entry point can become an ordinary loop header
+func splitEntryBlock(proc *Procedure) *BasicBlock {
+	header := proc.entryPoint
+	entry := &BasicBlock{
+		name:       proc.newBlockName(header.name),
+		span:       header.span,
+		jmpcode:    opcode_JMP,
+		jmpspan:    header.span,
+		successors: [2]*BasicBlock{header, nil},
+	}
+	proc.blocks = append([]*BasicBlock{entry}, proc.blocks...)
+	proc.entryPoint = entry
+	return entry
+}
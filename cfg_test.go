@@ -0,0 +1,48 @@
+package cube
+
+import "testing"
+
+func TestTopologicalSort_Components(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		entry:
+			jmp x
+		x:
+			jnz a, x, y
+		y:
+			jnz a, z, w
+		z:
+			jnz a, y, w
+		w:
+			ret a
+	}`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			components := map[string]int{}
+			for _, blk := range topologicalSort(proc.blocks) {
+				components[blk.name] = blk.sccomponent
+			}
+
+			if components["y"] != components["z"] {
+				t.Fatalf("y and z are in different components: %v", components)
+			}
+
+			seen := map[int]string{}
+			for _, name := range []string{"entry", "x", "y", "w"} {
+				if other, ok := seen[components[name]]; ok {
+					t.Fatalf("%s and %s share a component: %v", name, other, components)
+				}
+				seen[components[name]] = name
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,273 @@
+// Command cube checks, inspects, runs and builds cubeasm programs.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/askeladdk/cube"
+)
+
+const usage = `usage: cube <command> [flags] file.cubeasm [args...]
+
+commands:
+  check  report errors and warnings
+  ir     print the ir after optimization or after the passes named by -after,
+         or the control flow graphs in graphviz dot format with -dot
+  run    interpret a procedure, or compile it to native code with -jit or to
+         bytecode with -vm. files built with -target=bytecode run on the vm:
+         cube run file.cubeasm func args...
+  build  emit the module for a target
+`
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "cube: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// compiles the file at path and prints its diagnostics to stderr
+func load(path string, werror bool) *cube.Module {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	level := cube.CheckWarn
+	if werror {
+		level = cube.CheckError
+	}
+
+	var mod *cube.Module
+	err = cube.Compile(&cube.Config{
+		Filename:      path,
+		Source:        string(source),
+		Uninitialized: level,
+		InfiniteLoops: level,
+		Diagnostic: func(diag *cube.Diagnostic) {
+			fmt.Fprint(os.Stderr, diag.Render(string(source)))
+		},
+		Module: func(m *cube.Module) error {
+			mod = m
+			return nil
+		},
+	})
+
+	if _, ok := err.(cube.Diagnostics); ok {
+		os.Exit(1)
+	} else if err != nil {
+		fatalf("%s", err)
+	}
+	return mod
+}
+
+func optimize(pm *cube.PassManager, mod *cube.Module, level string) {
+	if err := pm.RunModule(mod, "-O"+level); err != nil {
+		fatalf("%s", err)
+	}
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, minargs int) []string {
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintf(os.Stderr, "\nflags of %s:\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < minargs {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	werror := fs.Bool("Werror", false, "treat warnings as errors")
+	for _, path := range parseFlags(fs, args, 1) {
+		load(path, *werror)
+	}
+}
+
+func ir(args []string) {
+	fs := flag.NewFlagSet("ir", flag.ExitOnError)
+	level := fs.String("O", "1", "optimization level")
+	after := fs.String("after", "", "comma separated passes after which to print the ir")
+	timings := fs.Bool("timings", false, "print the time spent in each pass")
+	dot := fs.Bool("dot", false, "print the control flow graphs in graphviz dot format")
+	dom := fs.Bool("dom", false, "overlay the dominator tree on the dot graphs")
+	args = parseFlags(fs, args, 1)
+
+	mod := load(args[0], false)
+	pm := cube.NewPassManager()
+	pm.Verify = true
+	if *after != "" {
+		pm.Dump = os.Stdout
+		pm.DumpAfter = strings.Split(*after, ",")
+	}
+
+	optimize(pm, mod, *level)
+	if *dot {
+		for _, proc := range mod.Procedures() {
+			cube.PrintDot(os.Stdout, proc, *dom)
+		}
+	} else if *after == "" {
+		cube.PrintModule(os.Stdout, mod)
+	}
+	if *timings {
+		pm.PrintTimings(os.Stderr)
+	}
+}
+
+func run(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	level := fs.String("O", "1", "optimization level")
+	steps := fs.Int("steps", 0, "abort after this many instructions if positive")
+	native := fs.Bool("jit", false, "compile to native code instead of interpreting")
+	bytecode := fs.Bool("vm", false, "compile to bytecode and run it on the vm instead of interpreting")
+	args = parseFlags(fs, args, 2)
+
+	var values []uint64
+	for _, arg := range args[2:] {
+		if num, err := strconv.ParseUint(arg, 0, 64); err == nil {
+			values = append(values, num)
+		} else if num, err := strconv.ParseInt(arg, 0, 64); err == nil {
+			values = append(values, uint64(num))
+		} else {
+			fatalf("invalid argument %s", arg)
+		}
+	}
+
+	// bytecode files run on the vm without parsing cubeasm
+	if source, err := ioutil.ReadFile(args[0]); err != nil {
+		fatalf("%s", err)
+	} else if bc, err := cube.ReadBytecode(bytes.NewReader(source)); err == nil {
+		vm := cube.NewVM(bc)
+		vm.MaxSteps = *steps
+		printResult(vm.Call(args[1], values...))
+		return
+	} else if err != cube.ErrNotBytecode {
+		fatalf("%s", err)
+	}
+
+	mod := load(args[0], false)
+	optimize(cube.NewPassManager(), mod, *level)
+
+	if *native {
+		fn, err := cube.JIT(mod, args[1])
+		if err != nil {
+			fatalf("%s", err)
+		}
+		defer func() {
+			if err := recover(); err != nil {
+				fatalf("%s", err)
+			}
+		}()
+		fmt.Println(fn(values...))
+	} else if *bytecode {
+		bc, err := cube.CompileBytecode(mod)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		vm := cube.NewVM(bc)
+		vm.MaxSteps = *steps
+		printResult(vm.Call(args[1], values...))
+	} else {
+		interp := cube.NewInterpreter(mod)
+		interp.MaxSteps = *steps
+		printResult(interp.Call(args[1], values...))
+	}
+}
+
+func printResult(result uint64, err error) {
+	if err != nil {
+		fatalf("%s", err)
+	} else {
+		fmt.Println(result)
+	}
+}
+
+func build(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	level := fs.String("O", "1", "optimization level")
+	output := fs.String("o", "-", "output file")
+	var names []string
+	for _, target := range cube.Targets() {
+		names = append(names, target.Name)
+	}
+	targetName := fs.String("target", "ir", "one of "+strings.Join(names, ", "))
+	pkg := fs.String("package", "cube", "package name of the go target")
+	args = parseFlags(fs, args, 1)
+
+	target := cube.LookupTarget(*targetName)
+	if target == nil {
+		fatalf("unknown target %s", *targetName)
+	}
+
+	emit := target.Emit
+	if target.Name == "go" {
+		emit = func(w io.Writer, mod *cube.Module) error {
+			return cube.PrintGo(w, mod, *pkg)
+		}
+	}
+
+	mod := load(args[0], false)
+	optimize(cube.NewPassManager(), mod, *level)
+
+	if *output == "-" {
+		if err := emit(os.Stdout, mod); err != nil {
+			fatalf("%s", err)
+		}
+		return
+	}
+
+	// the emitters ignore write errors, which the buffer keeps until it
+	// is flushed, and some only show up when the file is closed. a
+	// partial output is removed so that it is never mistaken for a good
+	// one, unless it is not a regular file such as a device.
+	f, err := os.Create(*output)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	bw := bufio.NewWriter(f)
+	if err = emit(bw, mod); err == nil {
+		err = bw.Flush()
+	}
+	info, _ := f.Stat()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if info != nil && info.Mode().IsRegular() {
+			os.Remove(*output)
+		}
+		fatalf("%s", err)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "check":
+		check(args)
+	case "ir":
+		ir(args)
+	case "run":
+		run(args)
+	case "build":
+		build(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,130 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+)
+
+type locationKind int
+
+const (
+	location_NONE locationKind = iota
+	// a register of the target
+	location_REG
+	// a spill slot in the frame
+	location_STACK
+	// an argument passed on the stack by the caller
+	location_ARG
+	// an entry of Procedure.constants
+	location_CON
+)
+
+// a location is where a value lives in generated code
+type location struct {
+	kind  locationKind
+	index int
+}
+
+func regLocation(reg int) location {
+	return location{location_REG, reg}
+}
+
+// a move copies the value at src to dst
+type move struct {
+	dst location
+	src location
+}
+
+// orders a parallel move, in which all sources are read before any
+// destination is written, into a sequence of moves. cycles are broken
+// by saving a value in scratch, which must not appear in moves.
+func sequentializeMoves(moves []move, scratch location) []move {
+	var pending []move
+	for _, m := range moves {
+		if m.dst != m.src {
+			pending = append(pending, m)
+		}
+	}
+
+	isSource := func(loc location, except int) bool {
+		for i, m := range pending {
+			if i != except && m.src == loc {
+				return true
+			}
+		}
+		return false
+	}
+
+	var result []move
+	for len(pending) > 0 {
+		ready := -1
+		for i, m := range pending {
+			if !isSource(m.dst, i) {
+				ready = i
+				break
+			}
+		}
+
+		if ready < 0 {
+			// every destination is still to be read, so save the first
+			// one in scratch and read it from there instead
+			saved := pending[0].dst
+			result = append(result, move{scratch, saved})
+			for i, _ := range pending {
+				if pending[i].src == saved {
+					pending[i].src = scratch
+				}
+			}
+			continue
+		}
+
+		result = append(result, pending[ready])
+		pending = append(pending[:ready], pending[ready+1:]...)
+	}
+
+	return result
+}
+
+// returns the reachable blocks of proc with the entry point first and
+// the others in the order of proc.blocks, and recomputes predecessors
+func codegenOrder(proc *Procedure) []*BasicBlock {
+	reached := map[*BasicBlock]struct{}{}
+	for _, blk := range predecessors(reachable(proc.entryPoint, proc.blocks)) {
+		reached[blk] = struct{}{}
+	}
+
+	order := []*BasicBlock{proc.entryPoint}
+	for _, blk := range proc.blocks {
+		if _, ok := reached[blk]; ok && blk != proc.entryPoint {
+			order = append(order, blk)
+		}
+	}
+	return order
+}
+
+// checks that proc can be handed to a backend
+func checkCodegen(proc *Procedure) error {
+	if len(proc.ssaregs) == 0 && len(proc.locals) > 0 {
+		return errors.New(fmt.Sprintf("procedure %s is not in ssa form", proc.name))
+	} else if proc.entryPoint == nil {
+		return errors.New(fmt.Sprintf("procedure %s has no entry point", proc.name))
+	}
+
+	for _, blk := range proc.blocks {
+		if blk.jmpcode == nil {
+			return errors.New(fmt.Sprintf("block %s of procedure %s has no terminator", blk, proc.name))
+		}
+	}
+	return nil
+}
+
+// the moves that pass the arguments of the jump from blk to its successor
+// succidx to the parameters of the successor
+func edgeMoves(proc *Procedure, alloc *allocation, blk *BasicBlock, succidx int) []move {
+	var moves []move
+	succ := blk.successors[succidx]
+	for i, val := range succ.ssaparams {
+		moves = append(moves, move{alloc.locations[val], alloc.operand(blk.jmpargs[succidx][i])})
+	}
+	return moves
+}
@@ -0,0 +1,582 @@
+package cube
+
+import "math"
+
+// returns the number of natural loops that contain every reachable
+// block. the blocks of a loop are those that reach the source of a back
+// edge without passing through the header, which dominates them all.
+func loopDepths(proc *Procedure) map[*BasicBlock]int {
+	dom := dominators(proc)
+	bodies := map[*BasicBlock]map[*BasicBlock]bool{}
+	var headers []*BasicBlock
+
+	for _, blk := range reversePostorder(proc.entryPoint) {
+		for _, header := range blk.successors {
+			if header == nil || !dom.dominates(header, blk) {
+				continue
+			}
+
+			body, ok := bodies[header]
+			if !ok {
+				body = map[*BasicBlock]bool{header: true}
+				bodies[header] = body
+				headers = append(headers, header)
+			}
+
+			worklist := []*BasicBlock{blk}
+			for len(worklist) > 0 {
+				b := worklist[len(worklist)-1]
+				worklist = worklist[:len(worklist)-1]
+				if !body[b] {
+					body[b] = true
+					worklist = append(worklist, b.predecessors...)
+				}
+			}
+		}
+	}
+
+	depths := map[*BasicBlock]int{}
+	for _, header := range headers {
+		for blk, _ := range bodies[header] {
+			depths[blk] += 1
+		}
+	}
+	return depths
+}
+
+type nodeState int
+
+const (
+	node_INITIAL nodeState = iota
+	node_PRECOLORED
+	node_SIMPLIFY
+	node_FREEZE
+	node_SPILL
+	node_SELECT
+	node_COALESCED
+	node_COLORED
+	node_SPILLED
+)
+
+type moveState int
+
+const (
+	move_WORKLIST moveState = iota
+	move_ACTIVE
+	move_COALESCED
+	move_CONSTRAINED
+	move_FROZEN
+)
+
+// a copy between two virtual registers that the allocator tries to
+// remove by giving both the same register
+type coloringMove struct {
+	dst, src int
+	state    moveState
+}
+
+// colorer holds the interference graph of the virtual registers of a
+// procedure followed by one precolored node for every register. the
+// worklists are slices that may hold nodes which have since moved on,
+// so they are popped by state.
+type colorer struct {
+	regs    *registerSet
+	nvregs  int
+	k       int
+	phys    []int
+	physidx map[int]int
+
+	adjSet   map[[2]int]bool
+	adjList  [][]int
+	degree   []int
+	state    []nodeState
+	alias    []int
+	color    []int
+	cost     []float64
+	occurs   []bool
+	moveList [][]*coloringMove
+
+	simplifyWorklist []int
+	freezeWorklist   []int
+	worklistMoves    []*coloringMove
+	selectStack      []int
+}
+
+func (this *colorer) isPrecolored(n int) bool {
+	return n >= this.nvregs
+}
+
+func (this *colorer) addEdge(u, v int) {
+	if u == v || this.adjSet[[2]int{u, v}] {
+		return
+	}
+	this.adjSet[[2]int{u, v}] = true
+	this.adjSet[[2]int{v, u}] = true
+	if !this.isPrecolored(u) {
+		this.adjList[u] = append(this.adjList[u], v)
+		this.degree[u] += 1
+	}
+	if !this.isPrecolored(v) {
+		this.adjList[v] = append(this.adjList[v], u)
+		this.degree[v] += 1
+	}
+}
+
+func (this *colorer) addMove(dst, src int) {
+	if dst == src {
+		return
+	}
+	m := &coloringMove{dst: dst, src: src}
+	this.worklistMoves = append(this.worklistMoves, m)
+	this.moveList[dst] = append(this.moveList[dst], m)
+	this.moveList[src] = append(this.moveList[src], m)
+}
+
+// builds the interference graph by walking every block backwards from
+// the registers that are live at its end. a register interferes with
+// everything that is live where it is defined, except with the source of
+// a copy that defines it. the registers that are live across a call
+// interfere with the registers that it clobbers. the parameters of a block
+// interfere with each other since the jumps write them at once.
+func (this *colorer) build(mp *machineProc) {
+	live := computeLiveness(mp.proc)
+	depths := loopDepths(mp.proc)
+
+	reg := func(op operand) (int, bool) {
+		otype, val := op.unpack()
+		if otype == operandType_REG {
+			this.occurs[val] = true
+		}
+		return val, otype == operandType_REG
+	}
+
+	for _, mb := range mp.blocks {
+		blk := mb.block
+		weight := math.Pow(10, float64(depths[blk]))
+
+		current := newBitset(this.nvregs)
+		current.union(live.liveout[blk])
+		blk.visitTerminatorUses(func(op *operand) {
+			if val, ok := reg(*op); ok {
+				current.set(val)
+				this.cost[val] += weight
+			}
+		})
+
+		// the arguments of the jumps are copied to the parameters
+		for i, succ := range blk.successors {
+			if succ != nil {
+				for j, val := range succ.ssaparams {
+					if arg, ok := reg(blk.jmpargs[i][j]); ok {
+						this.addMove(val, arg)
+					}
+				}
+			}
+		}
+
+		for i := len(mb.instrs) - 1; i >= 0; i-- {
+			mi := mb.instrs[i]
+			dst, isdef := reg(mi.dst)
+
+			if clobbered := this.regs.clobbered(mi); len(clobbered) > 0 {
+				current.each(func(val int) {
+					if !isdef || val != dst {
+						for _, r := range clobbered {
+							if idx, ok := this.physidx[r]; ok {
+								this.addEdge(val, idx)
+							}
+						}
+					}
+				})
+			}
+
+			if isdef {
+				copied := -1
+				if mi.opcode == machine_MOV {
+					if src, ok := reg(mi.srcs[0]); ok {
+						copied = src
+						this.addMove(dst, src)
+					}
+				}
+				current.each(func(val int) {
+					if val != copied {
+						this.addEdge(dst, val)
+					}
+				})
+				current.clear(dst)
+				this.cost[dst] += weight
+			}
+
+			for _, src := range mi.srcs {
+				if val, ok := reg(src); ok {
+					current.set(val)
+					this.cost[val] += weight
+				}
+			}
+		}
+
+		for _, val := range blk.ssaparams {
+			this.occurs[val] = true
+			current.set(val)
+			this.cost[val] += weight
+		}
+		for _, val := range blk.ssaparams {
+			current.each(func(other int) {
+				this.addEdge(val, other)
+			})
+		}
+	}
+}
+
+// returns the neighbours of n that are still in the graph
+func (this *colorer) adjacent(n int) []int {
+	var result []int
+	for _, m := range this.adjList[n] {
+		if this.state[m] != node_SELECT && this.state[m] != node_COALESCED {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (this *colorer) nodeMoves(n int) []*coloringMove {
+	var result []*coloringMove
+	for _, m := range this.moveList[n] {
+		if m.state == move_WORKLIST || m.state == move_ACTIVE {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+func (this *colorer) moveRelated(n int) bool {
+	return len(this.nodeMoves(n)) > 0
+}
+
+func (this *colorer) push(n int, state nodeState) {
+	this.state[n] = state
+	if state == node_SIMPLIFY {
+		this.simplifyWorklist = append(this.simplifyWorklist, n)
+	} else if state == node_FREEZE {
+		this.freezeWorklist = append(this.freezeWorklist, n)
+	}
+}
+
+func (this *colorer) makeWorklist() {
+	for n := 0; n < this.nvregs; n++ {
+		if !this.occurs[n] {
+			continue
+		} else if this.degree[n] >= this.k {
+			this.push(n, node_SPILL)
+		} else if this.moveRelated(n) {
+			this.push(n, node_FREEZE)
+		} else {
+			this.push(n, node_SIMPLIFY)
+		}
+	}
+}
+
+func (this *colorer) enableMoves(n int) {
+	for _, m := range this.nodeMoves(n) {
+		if m.state == move_ACTIVE {
+			m.state = move_WORKLIST
+			this.worklistMoves = append(this.worklistMoves, m)
+		}
+	}
+}
+
+func (this *colorer) decrementDegree(m int) {
+	if this.isPrecolored(m) {
+		return
+	}
+	this.degree[m] -= 1
+	if this.degree[m] == this.k-1 && this.state[m] == node_SPILL {
+		this.enableMoves(m)
+		for _, n := range this.adjacent(m) {
+			this.enableMoves(n)
+		}
+		if this.moveRelated(m) {
+			this.push(m, node_FREEZE)
+		} else {
+			this.push(m, node_SIMPLIFY)
+		}
+	}
+}
+
+func (this *colorer) simplify(n int) {
+	this.state[n] = node_SELECT
+	this.selectStack = append(this.selectStack, n)
+	for _, m := range this.adjacent(n) {
+		this.decrementDegree(m)
+	}
+}
+
+func (this *colorer) getAlias(n int) int {
+	for this.state[n] == node_COALESCED {
+		n = this.alias[n]
+	}
+	return n
+}
+
+func (this *colorer) addWorklist(u int) {
+	if !this.isPrecolored(u) && !this.moveRelated(u) && this.degree[u] < this.k && this.state[u] == node_FREEZE {
+		this.push(u, node_SIMPLIFY)
+	}
+}
+
+// george's test for coalescing v into the precolored u
+func (this *colorer) ok(t, u int) bool {
+	return this.degree[t] < this.k || this.isPrecolored(t) || this.adjSet[[2]int{t, u}]
+}
+
+// briggs's test: the combined node has fewer than k neighbours of
+// significant degree
+func (this *colorer) conservative(u, v int) bool {
+	seen := map[int]bool{}
+	k := 0
+	for _, n := range append(this.adjacent(u), this.adjacent(v)...) {
+		if !seen[n] {
+			seen[n] = true
+			if this.isPrecolored(n) || this.degree[n] >= this.k {
+				k += 1
+			}
+		}
+	}
+	return k < this.k
+}
+
+func (this *colorer) combine(u, v int) {
+	this.state[v] = node_COALESCED
+	this.alias[v] = u
+	this.moveList[u] = append(this.moveList[u], this.moveList[v]...)
+	this.enableMoves(v)
+	for _, t := range this.adjacent(v) {
+		this.addEdge(t, u)
+		this.decrementDegree(t)
+	}
+	if this.degree[u] >= this.k && this.state[u] == node_FREEZE {
+		this.push(u, node_SPILL)
+	}
+}
+
+func (this *colorer) coalesce(m *coloringMove) {
+	x, y := this.getAlias(m.dst), this.getAlias(m.src)
+	u, v := x, y
+	if this.isPrecolored(y) {
+		u, v = y, x
+	}
+
+	if u == v {
+		m.state = move_COALESCED
+		this.addWorklist(u)
+	} else if this.isPrecolored(v) || this.adjSet[[2]int{u, v}] {
+		m.state = move_CONSTRAINED
+		this.addWorklist(u)
+		this.addWorklist(v)
+	} else if this.canCombine(u, v) {
+		m.state = move_COALESCED
+		this.combine(u, v)
+		this.addWorklist(u)
+	} else {
+		m.state = move_ACTIVE
+	}
+}
+
+func (this *colorer) canCombine(u, v int) bool {
+	if !this.isPrecolored(u) {
+		return this.conservative(u, v)
+	}
+	for _, t := range this.adjacent(v) {
+		if !this.ok(t, u) {
+			return false
+		}
+	}
+	return true
+}
+
+// gives up on the copies of u, which may let the other registers of
+// those copies be simplified
+func (this *colorer) freezeMoves(u int) {
+	for _, m := range this.nodeMoves(u) {
+		v := this.getAlias(m.src)
+		if v == this.getAlias(u) {
+			v = this.getAlias(m.dst)
+		}
+		m.state = move_FROZEN
+		if this.state[v] == node_FREEZE && !this.moveRelated(v) {
+			this.push(v, node_SIMPLIFY)
+		}
+	}
+}
+
+// picks the register to spill that costs least for its degree
+func (this *colorer) selectSpill() {
+	best := -1
+	for n := 0; n < this.nvregs; n++ {
+		if this.state[n] != node_SPILL {
+			continue
+		} else if best < 0 || this.cost[n]/float64(this.degree[n]) < this.cost[best]/float64(this.degree[best]) {
+			best = n
+		}
+	}
+	this.push(best, node_SIMPLIFY)
+	this.freezeMoves(best)
+}
+
+func popWorklist(list *[]int, state []nodeState, want nodeState) (int, bool) {
+	for len(*list) > 0 {
+		n := (*list)[len(*list)-1]
+		*list = (*list)[:len(*list)-1]
+		if state[n] == want {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func (this *colorer) hasSpillCandidate() bool {
+	for n := 0; n < this.nvregs; n++ {
+		if this.state[n] == node_SPILL {
+			return true
+		}
+	}
+	return false
+}
+
+// pops the registers off the stack and gives each a register that none
+// of its neighbours has, preferring caller saved registers like
+// linearScan. the registers that are left without one are spilled.
+func (this *colorer) assignColors() {
+	for len(this.selectStack) > 0 {
+		n := this.selectStack[len(this.selectStack)-1]
+		this.selectStack = this.selectStack[:len(this.selectStack)-1]
+
+		taken := map[int]bool{}
+		for _, w := range this.adjList[n] {
+			if a := this.getAlias(w); this.state[a] == node_COLORED || this.isPrecolored(a) {
+				taken[this.color[a]] = true
+			}
+		}
+
+		this.state[n] = node_SPILLED
+		for _, r := range this.phys {
+			if !taken[r] {
+				this.state[n] = node_COLORED
+				this.color[n] = r
+				break
+			}
+		}
+	}
+}
+
+func (this *colorer) allocate(mp *machineProc) *allocation {
+	this.build(mp)
+	this.makeWorklist()
+
+	for {
+		if n, ok := popWorklist(&this.simplifyWorklist, this.state, node_SIMPLIFY); ok {
+			this.simplify(n)
+		} else if len(this.worklistMoves) > 0 {
+			m := this.worklistMoves[len(this.worklistMoves)-1]
+			this.worklistMoves = this.worklistMoves[:len(this.worklistMoves)-1]
+			if m.state == move_WORKLIST {
+				this.coalesce(m)
+			}
+		} else if n, ok := popWorklist(&this.freezeWorklist, this.state, node_FREEZE); ok {
+			this.push(n, node_SIMPLIFY)
+			this.freezeMoves(n)
+		} else if this.hasSpillCandidate() {
+			this.selectSpill()
+		} else {
+			break
+		}
+	}
+
+	this.assignColors()
+
+	alloc := &allocation{
+		locations: make([]location, this.nvregs),
+	}
+
+	// spilled registers that do not interfere share a slot. the edges of
+	// a coalesced register may only be recorded on its neighbours, so
+	// every list is visited.
+	conflicts := map[int][]int{}
+	for n := 0; n < this.nvregs; n++ {
+		if a := this.getAlias(n); this.occurs[n] && this.state[a] == node_SPILLED {
+			for _, w := range this.adjList[n] {
+				if b := this.getAlias(w); b != a && this.state[b] == node_SPILLED {
+					conflicts[a] = append(conflicts[a], b)
+					conflicts[b] = append(conflicts[b], a)
+				}
+			}
+		}
+	}
+
+	slots := make([]int, this.nvregs)
+	for n := 0; n < this.nvregs; n++ {
+		if this.state[n] != node_SPILLED {
+			continue
+		}
+		taken := map[int]bool{}
+		for _, b := range conflicts[n] {
+			if b < n {
+				taken[slots[b]] = true
+			}
+		}
+		for taken[slots[n]] {
+			slots[n] += 1
+		}
+		if slots[n] >= alloc.nslots {
+			alloc.nslots = slots[n] + 1
+		}
+	}
+
+	used := map[int]bool{}
+	for n := 0; n < this.nvregs; n++ {
+		if !this.occurs[n] {
+			continue
+		} else if a := this.getAlias(n); this.state[a] == node_SPILLED {
+			alloc.locations[n] = location{location_STACK, slots[a]}
+		} else {
+			alloc.locations[n] = regLocation(this.color[a])
+			used[this.color[a]] = true
+		}
+	}
+
+	alloc.calleeSaved = this.regs.toSave(mp, used)
+	return alloc
+}
+
+// assigns registers with george and appel's iterated register
+// coalescing. copies, including those of the arguments of jumps, are
+// coalesced when that cannot make the graph uncolorable, and the
+// registers to spill are picked by their uses weighted by loop depth.
+func graphColoring(mp *machineProc, regs *registerSet) *allocation {
+	phys := append(append([]int{}, regs.callerSaved...), regs.calleeSaved...)
+	n := mp.nvregs + len(phys)
+	this := &colorer{
+		regs:     regs,
+		nvregs:   mp.nvregs,
+		k:        len(phys),
+		phys:     phys,
+		physidx:  map[int]int{},
+		adjSet:   map[[2]int]bool{},
+		adjList:  make([][]int, n),
+		degree:   make([]int, n),
+		state:    make([]nodeState, n),
+		alias:    make([]int, n),
+		color:    make([]int, n),
+		cost:     make([]float64, n),
+		occurs:   make([]bool, n),
+		moveList: make([][]*coloringMove, n),
+	}
+
+	for i, r := range phys {
+		this.physidx[r] = mp.nvregs + i
+		this.state[mp.nvregs+i] = node_PRECOLORED
+		this.color[mp.nvregs+i] = r
+	}
+
+	return this.allocate(mp)
+}
@@ -0,0 +1,149 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphColoring(t *testing.T) {
+	source := `
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, id(b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}
+
+	func id(x u64) u64 {
+		entry:
+			ret x
+	}`
+
+	err := Compile(&Config{
+		Source: source,
+		Procedure: func(proc *Procedure) error {
+			proc, err := NewPassManager().RunPasses(proc, strings.Fields("cfg ssa copyprop simplify prune regalloc=coloring"))
+			if err != nil {
+				return err
+			} else if proc.name != "pow" {
+				return nil
+			} else if proc.regalloc != "coloring" {
+				t.Fatal(proc.regalloc)
+			}
+
+			order := codegenOrder(proc)
+			mp := selectInstructions(proc, order, riscv64Rules)
+			regs := riscv64CallingConvs.registers(&Module{}, proc)
+			alloc := allocateRegisters(mp, regs)
+
+			iscalleesaved := map[int]bool{}
+			for _, reg := range regs.calleeSaved {
+				iscalleesaved[reg] = true
+			}
+
+			for _, blk := range order {
+				// the arguments of the back edge are coalesced with the
+				// parameters of the loop
+				if blk.name == "body" {
+					for _, m := range edgeMoves(proc, alloc, blk, 0) {
+						if m.dst != m.src {
+							t.Fatal(m)
+						}
+					}
+				}
+				// the values that are live across the call are in
+				// callee saved registers
+				if blk.name == "loop" {
+					for _, val := range blk.ssaparams {
+						if loc := alloc.locations[val]; loc.kind != location_REG || !iscalleesaved[loc.index] {
+							t.Fatal(proc.ssaregs[val], loc)
+						}
+					}
+				}
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoopDepths(t *testing.T) {
+	source := `
+	func f(n u64) u64 {
+		var i u64
+		var j u64
+		entry:
+			jmp outer
+		outer:
+			jnz n, setup, done
+		setup:
+			mov j, n
+			jmp inner
+		inner:
+			jnz j, step, next
+		step:
+			sub j, j, 1
+			jmp inner
+		next:
+			sub n, n, 1
+			jmp outer
+		done:
+			ret n
+	}`
+
+	err := Compile(&Config{
+		Source: source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			depths := map[string]int{}
+			for blk, depth := range loopDepths(proc) {
+				depths[blk.name] = depth
+			}
+
+			for name, expected := range map[string]int{
+				"entry": 0, "outer": 1, "setup": 1, "inner": 2,
+				"step": 2, "next": 1, "done": 0,
+			} {
+				if depths[name] != expected {
+					t.Fatal(name, depths)
+				}
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPipelineOptions(t *testing.T) {
+	err := Compile(&Config{
+		Source: `
+		func f(x u64) u64 {
+			entry:
+				ret x
+		}`,
+		Procedure: func(proc *Procedure) error {
+			_, err := NewPassManager().RunPasses(proc, []string{"cfg", "regalloc=greedy"})
+			return err
+		},
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "unknown register allocator greedy") {
+		t.Fatal(err)
+	}
+}
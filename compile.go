@@ -1,9 +1,26 @@
 package cube
 
+type CheckLevel int
+
+const (
+	CheckIgnore CheckLevel = iota
+	CheckWarn
+	CheckError
+)
+
 type Config struct {
 	Procedure func(proc *Procedure) error
-	Filename  string
-	Source    string
+	Module    func(mod *Module) error
+	Warning   func(msg string)
+	// Diagnostic receives every error and warning as it is found
+	Diagnostic func(diag *Diagnostic)
+	Filename   string
+	Source     string
+
+	// Uninitialized reports reads of locals that may not have been assigned
+	Uninitialized CheckLevel
+	// InfiniteLoops reports procedures and loops from which ret cannot be reached
+	InfiniteLoops CheckLevel
 }
 
 func Compile(config *Config) error {
@@ -0,0 +1,42 @@
+package cube
+
+// Pass_CopyPropagation forwards the source operand of every register mov
+// into all uses of its destination and removes the mov.
+// the procedure must be in ssa form.
+func Pass_CopyPropagation(proc *Procedure) *Procedure {
+	copies := map[int]operand{}
+
+	for _, blk := range proc.blocks {
+		var instructions []Instruction
+		for _, insr := range blk.instructions {
+			if otype, val := insr.operands[0].unpack(); insr.opcode == opcode_MOV && otype == operandType_REG {
+				copies[val] = insr.operands[1]
+			} else {
+				instructions = append(instructions, insr)
+			}
+		}
+		blk.instructions = instructions
+	}
+
+	// follows chains of copies to the original operand
+	var resolve func(op operand) operand
+	resolve = func(op operand) operand {
+		if otype, val := op.unpack(); otype != operandType_REG {
+			return op
+		} else if src, iscopy := copies[val]; !iscopy {
+			return op
+		} else {
+			src = resolve(src)
+			copies[val] = src
+			return src
+		}
+	}
+
+	for _, blk := range proc.blocks {
+		blk.visitUses(func(op *operand) {
+			*op = resolve(*op)
+		})
+	}
+
+	return proc
+}
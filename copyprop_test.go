@@ -0,0 +1,59 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCopyPropagation_1(t *testing.T) {
+	source := `
+	func pow(b u64, e u64) u64 {
+	var r u64
+	entry:
+		mov r, 1
+		jmp loop
+	loop:
+		jnz e, body, done
+	body:
+		mul r, r, b
+		sub e, e, 1
+		jmp loop
+	done:
+		ret r
+	}`
+
+	expected := `func pow(b u64, e u64) u64 {
+ var r u64
+ entry(b.0, e.0):
+  jmp loop(b.0, e.0, 0x1)
+ loop(b.1, e.1, r.1):
+  jnz e.1, body(b.1, e.1, r.1), done(b.1, e.1, r.1)
+ body(b.2, e.2, r.2):
+  mul r.3, r.2, b.2
+  sub e.3, e.2, 0x1
+  jmp loop(b.2, e.3, r.3)
+ done(b.3, e.4, r.4):
+  ret r.4
+}
+`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			proc, _ = reallycrudessa(proc)
+			proc = Pass_CopyPropagation(proc)
+			var sb strings.Builder
+			printproc(&sb, proc)
+			if s := sb.String(); s != expected {
+				t.Fatal(s)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,271 @@
+package cube
+
+type dataflowDirection int
+
+const (
+	dataflow_FORWARD dataflowDirection = iota
+	dataflow_BACKWARD
+)
+
+// a dataflowProblem describes a lattice of bitsets over a procedure.
+// boundary is the value flowing into the entry point of a forward problem
+// or out of the exits of a backward problem, initial is the value every
+// other block starts out with. join merges src into dst.
+type dataflowProblem struct {
+	direction dataflowDirection
+	boundary  bitset
+	initial   bitset
+	join      func(dst, src bitset)
+	transfer  func(blk *BasicBlock, value bitset) bitset
+}
+
+// the values at the start and at the end of every reachable block
+type dataflowResult struct {
+	in  map[*BasicBlock]bitset
+	out map[*BasicBlock]bitset
+}
+
+func joinUnion(dst, src bitset) {
+	dst.union(src)
+}
+
+func joinIntersect(dst, src bitset) {
+	dst.intersect(src)
+}
+
+// solves a dataflow problem with a worklist, visiting the blocks in
+// reverse postorder for forward problems and in postorder for backward ones.
+func solveDataflow(proc *Procedure, problem *dataflowProblem) *dataflowResult {
+	result := &dataflowResult{
+		in:  map[*BasicBlock]bitset{},
+		out: map[*BasicBlock]bitset{},
+	}
+
+	blocks := reversePostorder(proc.entryPoint)
+	forward := problem.direction == dataflow_FORWARD
+	if !forward {
+		for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+			blocks[i], blocks[j] = blocks[j], blocks[i]
+		}
+	}
+
+	// src is the side a block receives its value from and dst the side
+	// its transfer function produces
+	src, dst := result.in, result.out
+	if !forward {
+		src, dst = result.out, result.in
+	}
+
+	reachable := map[*BasicBlock]struct{}{}
+	for _, blk := range blocks {
+		reachable[blk] = struct{}{}
+		src[blk] = problem.initial.copy()
+		dst[blk] = problem.initial.copy()
+	}
+
+	incoming := func(blk *BasicBlock) []*BasicBlock {
+		if forward {
+			return blk.predecessors
+		}
+		var succs []*BasicBlock
+		for _, succ := range blk.successors {
+			if succ != nil {
+				succs = append(succs, succ)
+			}
+		}
+		return succs
+	}
+
+	outgoing := func(blk *BasicBlock) []*BasicBlock {
+		if !forward {
+			return blk.predecessors
+		}
+		var succs []*BasicBlock
+		for _, succ := range blk.successors {
+			if succ != nil {
+				succs = append(succs, succ)
+			}
+		}
+		return succs
+	}
+
+	worklist := append([]*BasicBlock{}, blocks...)
+	onworklist := map[*BasicBlock]struct{}{}
+	for _, blk := range blocks {
+		onworklist[blk] = struct{}{}
+	}
+
+	for len(worklist) > 0 {
+		blk := worklist[0]
+		worklist = worklist[1:]
+		delete(onworklist, blk)
+
+		var value bitset
+		isboundary := (forward && blk == proc.entryPoint) || (!forward && blk.jmpcode == opcode_RET)
+		if isboundary {
+			value = problem.boundary.copy()
+		}
+		for _, other := range incoming(blk) {
+			if _, ok := reachable[other]; !ok {
+				continue
+			} else if value == nil {
+				value = dst[other].copy()
+			} else {
+				problem.join(value, dst[other])
+			}
+		}
+		if value == nil {
+			value = problem.initial.copy()
+		}
+
+		src[blk] = value
+		newvalue := problem.transfer(blk, value.copy())
+		if !newvalue.equal(dst[blk]) {
+			dst[blk] = newvalue
+			for _, other := range outgoing(blk) {
+				if _, ok := onworklist[other]; !ok {
+					if _, ok := reachable[other]; ok {
+						worklist = append(worklist, other)
+						onworklist[other] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// a definition of a local by an instruction, or by the caller if it
+// is a parameter and index is -1
+type definition struct {
+	block *BasicBlock
+	index int
+	local int
+}
+
+type reachingDefinitions struct {
+	defs   []definition
+	result *dataflowResult
+}
+
+// computes the definitions of locals that reach the start and the end
+// of every block. the procedure must not be in ssa form.
+func computeReachingDefinitions(proc *Procedure) *reachingDefinitions {
+	this := &reachingDefinitions{}
+
+	for i, _ := range proc.locals {
+		if proc.locals[i].isParameter {
+			this.defs = append(this.defs, definition{nil, -1, i})
+		}
+	}
+
+	defsof := map[int][]int{}
+	blockdefs := map[*BasicBlock][]int{}
+	for _, blk := range proc.blocks {
+		for i, insr := range blk.instructions {
+			if otype, val := insr.operands[0].unpack(); otype == operandType_LOC {
+				blockdefs[blk] = append(blockdefs[blk], len(this.defs))
+				this.defs = append(this.defs, definition{blk, i, val})
+			}
+		}
+	}
+
+	boundary := newBitset(len(this.defs))
+	for i, def := range this.defs {
+		defsof[def.local] = append(defsof[def.local], i)
+		if def.index < 0 {
+			boundary.set(i)
+		}
+	}
+
+	this.result = solveDataflow(proc, &dataflowProblem{
+		direction: dataflow_FORWARD,
+		boundary:  boundary,
+		initial:   newBitset(len(this.defs)),
+		join:      joinUnion,
+		transfer: func(blk *BasicBlock, value bitset) bitset {
+			for _, d := range blockdefs[blk] {
+				for _, kill := range defsof[this.defs[d].local] {
+					value.clear(kill)
+				}
+				value.set(d)
+			}
+			return value
+		},
+	})
+
+	return this
+}
+
+// an expression computed by an instruction
+type expression struct {
+	opcode *opcode
+	op1    operand
+	op2    operand
+}
+
+type availableExpressions struct {
+	exprs  []expression
+	result *dataflowResult
+}
+
+func (this *availableExpressions) index(insr *Instruction) int {
+	expr := expression{insr.opcode, insr.operands[1], insr.operands[2]}
+	for i, e := range this.exprs {
+		if e == expr {
+			return i
+		}
+	}
+	return -1
+}
+
+// computes the expressions that have been evaluated on every path to the
+// start and the end of every block. in ssa form operands are never
+// redefined, otherwise assigning a local kills every expression using it.
+func computeAvailableExpressions(proc *Procedure) *availableExpressions {
+	this := &availableExpressions{}
+
+	for _, blk := range proc.blocks {
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			if insr.opcode != opcode_MOV && insr.opcode != opcode_CALL && this.index(insr) < 0 {
+				this.exprs = append(this.exprs, expression{insr.opcode, insr.operands[1], insr.operands[2]})
+			}
+		}
+	}
+
+	uses := map[operand][]int{}
+	for i, expr := range this.exprs {
+		uses[expr.op1] = append(uses[expr.op1], i)
+		uses[expr.op2] = append(uses[expr.op2], i)
+	}
+
+	initial := newBitset(len(this.exprs))
+	for i, _ := range this.exprs {
+		initial.set(i)
+	}
+
+	this.result = solveDataflow(proc, &dataflowProblem{
+		direction: dataflow_FORWARD,
+		boundary:  newBitset(len(this.exprs)),
+		initial:   initial,
+		join:      joinIntersect,
+		transfer: func(blk *BasicBlock, value bitset) bitset {
+			for i, _ := range blk.instructions {
+				insr := &blk.instructions[i]
+				if e := this.index(insr); e >= 0 {
+					value.set(e)
+				}
+				if insr.operands[0].otype == operandType_LOC {
+					for _, e := range uses[insr.operands[0]] {
+						value.clear(e)
+					}
+				}
+			}
+			return value
+		},
+	})
+
+	return this
+}
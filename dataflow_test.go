@@ -0,0 +1,86 @@
+package cube
+
+import "testing"
+
+func TestDataflow_ReachingDefinitions(t *testing.T) {
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   livenessSource,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			rd := computeReachingDefinitions(proc)
+
+			// b, e, r = 1, t = 5, r = r * b, e = e - 1
+			if len(rd.defs) != 6 {
+				t.Fatalf("wrong nr of definitions")
+			}
+
+			var reaching []int
+			for _, blk := range proc.blocks {
+				if blk.name == "done" {
+					rd.result.in[blk].each(func(i int) {
+						reaching = append(reaching, i)
+					})
+				}
+			}
+
+			if len(reaching) != len(rd.defs) {
+				t.Fatalf("wrong reaching definitions %v", reaching)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataflow_AvailableExpressions(t *testing.T) {
+	source := `
+	func f(a u64, b u64) u64 {
+		var c u64
+		var d u64
+		entry:
+			add c, a, b
+			jnz c, x, y
+		x:
+			mul d, a, b
+			jmp z
+		y:
+			mul d, a, b
+			mov a, 1
+			jmp z
+		z:
+			ret d
+	}`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			ae := computeAvailableExpressions(proc)
+			for _, blk := range proc.blocks {
+				if blk.name != "z" {
+					continue
+				} else if in := ae.result.in[blk]; in.count() != 0 {
+					t.Fatalf("a was redefined in y")
+				}
+			}
+
+			for _, blk := range proc.blocks {
+				if blk.name != "x" {
+					continue
+				} else if in := ae.result.in[blk]; in.count() != 1 || !in.has(0) {
+					t.Fatalf("a + b should be available in x")
+				}
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package cube
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (this Severity) String() string {
+	if this == SeverityWarning {
+		return "warning"
+	} else {
+		return "error"
+	}
+}
+
+// diagnostic codes
+const (
+	diag_ILLEGAL       = "E0001"
+	diag_SYNTAX        = "E0002"
+	diag_INTEGER       = "E0003"
+	diag_REDEFINED     = "E0004"
+	diag_UNDEFINED     = "E0005"
+	diag_ARGUMENTS     = "E0006"
+	diag_TERMINATOR    = "E0007"
+	diag_RETURNTYPE    = "E0008"
+	diag_UNINITIALIZED = "E0009"
+	diag_NORETURN      = "E0010"
+	diag_CALLCONV      = "E0011"
+)
+
+type Diagnostic struct {
+	Severity Severity
+	Filename string
+	Line     int
+	Column   int
+	// Offset and Length are the byte range of the offending text
+	Offset  int
+	Length  int
+	Code    string
+	Message string
+}
+
+func (this *Diagnostic) Error() string {
+	if this.Severity == SeverityWarning {
+		return fmt.Sprintf("%s:%d: warning: %s", this.Filename, this.Line, this.Message)
+	} else {
+		return fmt.Sprintf("%s:%d: %s", this.Filename, this.Line, this.Message)
+	}
+}
+
+// Render formats the diagnostic with the offending line of source
+// and a caret underlining the offending text
+func (this *Diagnostic) Render(source string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:%d:%d: %s[%s]: %s\n",
+		this.Filename, this.Line, this.Column, this.Severity, this.Code, this.Message)
+
+	if this.Offset < 0 || this.Offset > len(source) {
+		return sb.String()
+	}
+
+	start := strings.LastIndexByte(source[:this.Offset], '\n') + 1
+	end := len(source)
+	if i := strings.IndexByte(source[this.Offset:], '\n'); i >= 0 {
+		end = this.Offset + i
+	}
+
+	line := strings.TrimRight(source[start:end], "\r")
+	sb.WriteString(line)
+	sb.WriteByte('\n')
+
+	// keep tabs so the caret lines up with the text above it
+	for _, ch := range source[start:this.Offset] {
+		if ch == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+
+	sb.WriteByte('^')
+	stop := this.Offset + this.Length
+	if stop > end {
+		stop = end
+	}
+	for i := utf8.RuneCountInString(source[this.Offset:stop]); i > 1; i-- {
+		sb.WriteByte('~')
+	}
+	sb.WriteByte('\n')
+
+	return sb.String()
+}
+
+// Diagnostics is returned by Compile when at least one error was found.
+// it holds every error and warning in the order they were found.
+type Diagnostics []*Diagnostic
+
+func (this Diagnostics) Error() string {
+	var lines []string
+	for _, diag := range this {
+		lines = append(lines, diag.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (this Diagnostics) errors() int {
+	n := 0
+	for _, diag := range this {
+		if diag.Severity == SeverityError {
+			n += 1
+		}
+	}
+	return n
+}
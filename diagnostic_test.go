@@ -0,0 +1,28 @@
+package cube
+
+import "testing"
+
+func TestDiagnostic_Render(t *testing.T) {
+	source := "func f(a u64) u64 {\n\tentry:\n\t\tadd a, bb, 1\n\t\tret a\n}"
+
+	var diag *Diagnostic
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Diagnostic: func(d *Diagnostic) {
+			diag = d
+		},
+	})
+
+	if err == nil || diag == nil {
+		t.Fatal(err)
+	}
+
+	expected := "test.cubeasm:3:10: error[E0005]: undefined local 'bb' referenced here\n" +
+		"\t\tadd a, bb, 1\n" +
+		"\t\t       ^~\n"
+
+	if rendered := diag.Render(source); rendered != expected {
+		t.Fatal(rendered)
+	}
+}
@@ -0,0 +1,94 @@
+package cube
+
+type dominatorTree struct {
+	idom  map[*BasicBlock]*BasicBlock
+	order map[*BasicBlock]int
+}
+
+func reversePostorder(root *BasicBlock) []*BasicBlock {
+	visited := map[*BasicBlock]struct{}{}
+	var result []*BasicBlock
+	var recurse func(*BasicBlock)
+	recurse = func(blk *BasicBlock) {
+		visited[blk] = struct{}{}
+		for _, succ := range blk.successors {
+			if _, hasvisited := visited[succ]; succ != nil && !hasvisited {
+				recurse(succ)
+			}
+		}
+		result = append(result, blk)
+	}
+	recurse(root)
+
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+
+	return result
+}
+
+// cooper, harvey and kennedy's iterative dominator algorithm
+func dominators(proc *Procedure) *dominatorTree {
+	blocks := reversePostorder(proc.entryPoint)
+	order := map[*BasicBlock]int{}
+	for i, blk := range blocks {
+		order[blk] = i
+	}
+
+	idom := map[*BasicBlock]*BasicBlock{
+		proc.entryPoint: proc.entryPoint,
+	}
+
+	intersect := func(a, b *BasicBlock) *BasicBlock {
+		for a != b {
+			for order[a] > order[b] {
+				a = idom[a]
+			}
+			for order[b] > order[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, blk := range blocks[1:] {
+			var newidom *BasicBlock
+			for _, pred := range blk.predecessors {
+				if _, ok := idom[pred]; !ok {
+					continue
+				} else if newidom == nil {
+					newidom = pred
+				} else {
+					newidom = intersect(pred, newidom)
+				}
+			}
+			if idom[blk] != newidom {
+				idom[blk] = newidom
+				changed = true
+			}
+		}
+	}
+
+	delete(idom, proc.entryPoint)
+
+	return &dominatorTree{
+		idom:  idom,
+		order: order,
+	}
+}
+
+// returns the immediate dominator of blk or nil for the entry point
+func (this *dominatorTree) immediateDominator(blk *BasicBlock) *BasicBlock {
+	return this.idom[blk]
+}
+
+func (this *dominatorTree) dominates(a, b *BasicBlock) bool {
+	for ; b != nil; b = this.idom[b] {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
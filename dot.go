@@ -0,0 +1,75 @@
+package cube
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// the fill colors of strongly connected components cycle through
+// the twelve colors of the graphviz set312 scheme
+const dotColors = 12
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+func dotLabel(proc *Procedure, blk *BasicBlock) string {
+	var sb strings.Builder
+	printBlockHeader(&sb, proc, blk)
+	fmt.Fprintf(&sb, "\n")
+
+	for i, _ := range blk.instructions {
+		printInstruction(&sb, proc, &blk.instructions[i])
+		fmt.Fprintf(&sb, "\n")
+	}
+	printTerminator(&sb, proc, blk)
+	fmt.Fprintf(&sb, "\n")
+
+	// left justify every line
+	return strings.Replace(dotEscape(sb.String()), "\n", `\l`, -1)
+}
+
+// PrintDot writes the control flow graph of proc in graphviz dot format.
+// blocks are filled with a color per strongly connected component, which
+// is only meaningful after the cfg pass. if showDominators is true the
+// edges of the dominator tree are drawn as dashed lines.
+func PrintDot(w io.Writer, proc *Procedure, showDominators bool) {
+	fmt.Fprintf(w, "digraph \"%s\" {\n", dotEscape(proc.name))
+	fmt.Fprintf(w, "\tnode [shape=box fontname=monospace style=filled colorscheme=set312];\n")
+
+	for _, blk := range proc.blocks {
+		fmt.Fprintf(w, "\t\"%s\" [label=\"%s\" fillcolor=%d",
+			dotEscape(blk.name), dotLabel(proc, blk), blk.sccomponent%dotColors+1)
+		if blk == proc.entryPoint {
+			fmt.Fprintf(w, " penwidth=2")
+		}
+		fmt.Fprintf(w, "];\n")
+	}
+
+	for _, blk := range proc.blocks {
+		for i, succ := range blk.successors {
+			if succ == nil {
+				continue
+			}
+			fmt.Fprintf(w, "\t\"%s\" -> \"%s\"", dotEscape(blk.name), dotEscape(succ.name))
+			if blk.jmpcode == opcode_JNZ {
+				fmt.Fprintf(w, " [label=%t]", i == 0)
+			}
+			fmt.Fprintf(w, ";\n")
+		}
+	}
+
+	if showDominators && proc.entryPoint != nil {
+		predecessors(reachable(proc.entryPoint, proc.blocks))
+		domtree := dominators(proc)
+		for _, blk := range proc.blocks {
+			if idom := domtree.immediateDominator(blk); idom != nil {
+				fmt.Fprintf(w, "\t\"%s\" -> \"%s\" [style=dashed color=blue constraint=false];\n",
+					dotEscape(idom.name), dotEscape(blk.name))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "}\n")
+}
@@ -0,0 +1,39 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintDot(t *testing.T) {
+	expected := `digraph "pow" {
+	node [shape=box fontname=monospace style=filled colorscheme=set312];
+	"entry" [label="entry:\lmov r, 0x1\lmov t, 0x5\ljmp loop\l" fillcolor=3 penwidth=2];
+	"loop" [label="loop:\ljnz e, body, done\l" fillcolor=2];
+	"body" [label="body:\lmul r, r, b\lsub e, e, 0x1\ljmp loop\l" fillcolor=2];
+	"done" [label="done:\lret r\l" fillcolor=1];
+	"entry" -> "loop";
+	"loop" -> "body" [label=true];
+	"loop" -> "done" [label=false];
+	"body" -> "loop";
+	"entry" -> "loop" [style=dashed color=blue constraint=false];
+	"loop" -> "body" [style=dashed color=blue constraint=false];
+	"loop" -> "done" [style=dashed color=blue constraint=false];
+}
+`
+
+	err := Compile(&Config{
+		Source: livenessSource,
+		Procedure: func(proc *Procedure) error {
+			var sb strings.Builder
+			if PrintDot(&sb, Pass_BuildCFG(proc), true); sb.String() != expected {
+				t.Fatal(sb.String())
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
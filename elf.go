@@ -0,0 +1,159 @@
+package cube
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+)
+
+// the sections of the object file in the order of their headers
+const (
+	elfSection_NULL = iota
+	elfSection_TEXT
+	elfSection_RELA_TEXT
+	elfSection_SYMTAB
+	elfSection_STRTAB
+	elfSection_SHSTRTAB
+	elfSection_NOTE_GNU_STACK
+	elfSections
+)
+
+// a string table in which every string is stored once
+type elfStrtab struct {
+	data    []byte
+	offsets map[string]uint32
+}
+
+func newElfStrtab() *elfStrtab {
+	return &elfStrtab{
+		data:    []byte{0},
+		offsets: map[string]uint32{"": 0},
+	}
+}
+
+func (this *elfStrtab) add(s string) uint32 {
+	if offset, ok := this.offsets[s]; ok {
+		return offset
+	}
+	offset := uint32(len(this.data))
+	this.data = append(append(this.data, s...), 0)
+	this.offsets[s] = offset
+	return offset
+}
+
+// the sizes of the file header, a section header and a relocation
+const (
+	elfHeaderSize  = 64
+	elfSectionSize = 64
+	elfRelaSize    = 24
+)
+
+func elfAlign(buf *bytes.Buffer, align int) {
+	for buf.Len()%align != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// writeELF64 writes code as an elf64 relocatable object for x86-64. every
+// symbol is a global function in .text and every relocation a call.
+func writeELF64(w io.Writer, code *objectCode) error {
+	strtab := newElfStrtab()
+	shstrtab := newElfStrtab()
+
+	// the null symbol, then the local section symbol of .text and then
+	// the global symbols of the procedures
+	symbols := []elf.Sym64{
+		{},
+		{Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_SECTION), Shndx: elfSection_TEXT},
+	}
+	firstGlobal := len(symbols)
+	index := map[string]int{}
+	for _, sym := range code.symbols {
+		index[sym.name] = len(symbols)
+		symbols = append(symbols, elf.Sym64{
+			Name:  strtab.add(sym.name),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Shndx: elfSection_TEXT,
+			Value: uint64(sym.offset),
+			Size:  uint64(sym.size),
+		})
+	}
+
+	// calls go through the plt so that the callee may be in a shared
+	// object. the displacement is relative to the end of the field.
+	var relocations []elf.Rela64
+	for _, reloc := range code.relocations {
+		relocations = append(relocations, elf.Rela64{
+			Off:    uint64(reloc.offset),
+			Info:   elf.R_INFO(uint32(index[reloc.symbol]), uint32(elf.R_X86_64_PLT32)),
+			Addend: -4,
+		})
+	}
+
+	headers := make([]elf.Section64, elfSections)
+	var body bytes.Buffer
+	section := func(idx int, name string, stype elf.SectionType, flags elf.SectionFlag, align int, data interface{}) {
+		elfAlign(&body, align)
+		offset := body.Len()
+		binary.Write(&body, binary.LittleEndian, data)
+		headers[idx] = elf.Section64{
+			Name:      shstrtab.add(name),
+			Type:      uint32(stype),
+			Flags:     uint64(flags),
+			Off:       uint64(elfHeaderSize + offset),
+			Size:      uint64(body.Len() - offset),
+			Addralign: uint64(align),
+		}
+	}
+
+	section(elfSection_TEXT, ".text", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, 16, code.text)
+	section(elfSection_RELA_TEXT, ".rela.text", elf.SHT_RELA, elf.SHF_INFO_LINK, 8, relocations)
+	headers[elfSection_RELA_TEXT].Link = elfSection_SYMTAB
+	headers[elfSection_RELA_TEXT].Info = elfSection_TEXT
+	headers[elfSection_RELA_TEXT].Entsize = elfRelaSize
+	section(elfSection_SYMTAB, ".symtab", elf.SHT_SYMTAB, 0, 8, symbols)
+	headers[elfSection_SYMTAB].Link = elfSection_STRTAB
+	headers[elfSection_SYMTAB].Info = uint32(firstGlobal)
+	headers[elfSection_SYMTAB].Entsize = elf.Sym64Size
+	section(elfSection_STRTAB, ".strtab", elf.SHT_STRTAB, 0, 1, strtab.data)
+	// marks the stack as not executable
+	section(elfSection_NOTE_GNU_STACK, ".note.GNU-stack", elf.SHT_PROGBITS, 0, 1, []byte{})
+	shstrtab.add(".shstrtab")
+	section(elfSection_SHSTRTAB, ".shstrtab", elf.SHT_STRTAB, 0, 1, shstrtab.data)
+
+	elfAlign(&body, 8)
+	header := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(elfHeaderSize + body.Len()),
+		Ehsize:    elfHeaderSize,
+		Shentsize: elfSectionSize,
+		Shnum:     elfSections,
+		Shstrndx:  elfSection_SHSTRTAB,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	header.Ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+
+	binary.Write(&body, binary.LittleEndian, headers)
+
+	if err := binary.Write(w, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// emitELF64 writes mod as an elf64 relocatable object with one global
+// function symbol per procedure. the procedures must be in ssa form.
+func emitELF64(w io.Writer, mod *Module) error {
+	if code, err := encodeAMD64(mod, false); err != nil {
+		return err
+	} else {
+		return writeELF64(w, code)
+	}
+}
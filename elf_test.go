@@ -0,0 +1,90 @@
+package cube
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteELF64(t *testing.T) {
+	var buf bytes.Buffer
+	err := Compile(&Config{
+		Source: `
+		func square(x u64) u64 {
+			var y u64
+			entry:
+				mul y, x, x
+				ret y
+		}
+
+		func quad(x u64) u64 {
+			entry:
+				call x, square(x)
+				call x, square(x)
+				ret x
+		}`,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O1"); err != nil {
+				return err
+			}
+			return emitELF64(&buf, mod)
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if f.Type != elf.ET_REL || f.Machine != elf.EM_X86_64 || f.Class != elf.ELFCLASS64 {
+		t.Fatal(f.FileHeader)
+	}
+
+	text := f.Section(".text")
+	if text == nil || text.Flags != elf.SHF_ALLOC|elf.SHF_EXECINSTR {
+		t.Fatal(text)
+	} else if f.Section(".note.GNU-stack") == nil {
+		t.Fatal("missing .note.GNU-stack")
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, sym := range symbols {
+		if elf.ST_BIND(sym.Info) == elf.STB_GLOBAL {
+			if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Section != 1 || sym.Size == 0 {
+				t.Fatal(sym)
+			}
+			names = append(names, sym.Name)
+		}
+	}
+	if len(names) != 2 || names[0] != "square" || names[1] != "quad" {
+		t.Fatal(names)
+	}
+
+	// both calls in quad refer to square
+	rela := f.Section(".rela.text")
+	data, err := rela.Data()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != 2*elfRelaSize {
+		t.Fatal(len(data))
+	}
+
+	for i := 0; i < 2; i++ {
+		var r elf.Rela64
+		if err := binary.Read(bytes.NewReader(data[i*elfRelaSize:]), binary.LittleEndian, &r); err != nil {
+			t.Fatal(err)
+		} else if elf.R_TYPE64(r.Info) != uint32(elf.R_X86_64_PLT32) || r.Addend != -4 {
+			t.Fatal(r)
+		} else if sym := symbols[elf.R_SYM64(r.Info)-1]; sym.Name != "square" {
+			t.Fatal(sym)
+		}
+	}
+}
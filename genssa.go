@@ -3,31 +3,45 @@ package cube
 import "errors"
 
 func reallycrudessa(proc *Procedure) (*Procedure, error) {
+	// the entry point takes only the parameters, so jumps back to it
+	// would drop the other locals. such procedures get a fresh entry.
+	predecessors(reachable(proc.entryPoint, proc.blocks))
+	if len(proc.entryPoint.predecessors) > 0 {
+		splitEntryBlock(proc)
+		proc = Pass_BuildCFG(proc)
+	}
+
 	ssadef := func(localidx int) int {
 		local := &proc.locals[localidx]
-		ssaregidx := len(proc.ssaregs)
-		proc.ssaregs = append(proc.ssaregs, SSAReg{
-			local:      local,
-			generation: local.generations,
-		})
-		local.generations += 1
+		ssaregidx := proc.newSSAReg(local)
 		local.lastssareg = ssaregidx
 		local.isDefined = true
 		return ssaregidx
 	}
 
-	ssause := func(localidx int) int {
-		local := proc.locals[localidx]
-		return local.lastssareg
+	// locals that are read before they are assigned on entry are zero,
+	// which never aliases the register of another local
+	ssause := func(localidx int) operand {
+		if local := proc.locals[localidx]; !local.isDefined {
+			return operandCon(proc.constant(0))
+		} else {
+			return operandReg(local.lastssareg)
+		}
 	}
 
 	for localidx, _ := range proc.locals {
 		proc.locals[localidx].isDefined = proc.locals[localidx].isParameter
 	}
 
+	// the entry point takes the parameters and every other block takes
+	// all locals so that the arguments of each jump match its target
+	isparam := func(blk *BasicBlock, localidx int) bool {
+		return blk != proc.entryPoint || proc.locals[localidx].isParameter
+	}
+
 	for _, blk := range proc.blocks {
 		for localidx, _ := range proc.locals {
-			if proc.locals[localidx].isDefined {
+			if isparam(blk, localidx) {
 				ssaregidx := ssadef(localidx)
 				blk.ssaparams = append(blk.ssaparams, ssaregidx)
 			}
@@ -40,12 +54,18 @@ func reallycrudessa(proc *Procedure) (*Procedure, error) {
 			op1 := insr.operands[1]
 			op2 := insr.operands[2]
 
+			for j, arg := range insr.arguments {
+				if otype, val := arg.unpack(); otype == operandType_LOC {
+					insr.arguments[j] = ssause(val)
+				}
+			}
+
 			if otype, val := op2.unpack(); otype == operandType_LOC {
-				insr.operands[2] = operandReg(ssause(val))
+				insr.operands[2] = ssause(val)
 			}
 
 			if otype, val := op1.unpack(); otype == operandType_LOC {
-				insr.operands[1] = operandReg(ssause(val))
+				insr.operands[1] = ssause(val)
 			}
 
 			if otype, val := op0.unpack(); otype == operandType_LOC {
@@ -56,16 +76,15 @@ func reallycrudessa(proc *Procedure) (*Procedure, error) {
 		}
 
 		for localidx, _ := range proc.locals {
-			ssaregidx := ssause(localidx)
 			for i, succ := range blk.successors {
-				if succ != nil {
-					blk.jmpargs[i] = append(blk.jmpargs[i], ssaregidx)
+				if succ != nil && isparam(succ, localidx) {
+					blk.jmpargs[i] = append(blk.jmpargs[i], ssause(localidx))
 				}
 			}
 		}
 
 		if otype, val := blk.jmpretval.unpack(); otype == operandType_LOC {
-			blk.jmpretval = operandReg(ssause(val))
+			blk.jmpretval = ssause(val)
 		}
 	}
 
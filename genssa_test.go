@@ -40,3 +40,85 @@ func TestSSA_1(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSSA_Unassigned(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+	var b u64
+	entry:
+		jnz a, y, x
+	x:
+		mov b, 3
+		jmp y
+	y:
+		ret b
+	}`
+
+	var text string
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        source,
+		Uninitialized: CheckIgnore,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			proc, _ = reallycrudessa(proc)
+			var sb strings.Builder
+			printproc(&sb, proc)
+			text = sb.String()
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(text, "jnz a.0, y(a.0, 0x0), x(a.0, 0x0)\n") {
+		t.Fatal(text)
+	}
+}
+
+func TestSSA_LoopToEntry(t *testing.T) {
+	source := `
+	func f(n u64) u64 {
+	var s u64
+	entry:
+		add s, s, n
+		sub n, n, 1
+		jnz n, entry, done
+	done:
+		ret s
+	}`
+
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        source,
+		Uninitialized: CheckIgnore,
+		Module: func(mod *Module) error {
+			interp := NewInterpreter(mod)
+			if res, err := interp.Call("f", 4); err != nil {
+				return err
+			} else if res != 10 {
+				t.Fatalf("before ssa: expected 10 but got %d", res)
+			}
+
+			proc := Pass_BuildCFG(mod.lookup("f"))
+			if _, err := reallycrudessa(proc); err != nil {
+				return err
+			} else if len(proc.entryPoint.predecessors) > 0 {
+				t.Fatal("entry point has predecessors")
+			}
+
+			if res, err := interp.Call("f", 4); err != nil {
+				return err
+			} else if res != 10 {
+				var sb strings.Builder
+				printproc(&sb, proc)
+				t.Fatalf("after ssa: expected 10 but got %d\n%s", res, sb.String())
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
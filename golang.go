@@ -0,0 +1,305 @@
+package cube
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"strings"
+)
+
+type goEmitter struct {
+	w    *bytes.Buffer
+	proc *Procedure
+	// the go names of the procedures
+	funcs map[string]string
+	// the go names of the ssa registers, or _ if they are never read
+	regs   []string
+	needed map[int]bool
+	// the blocks that are the target of a goto
+	targets map[*BasicBlock]bool
+}
+
+// returns name or name with enough underscores appended to make it a
+// valid identifier that is not in taken
+func goIdentifier(name string, taken map[string]bool) string {
+	for token.IsKeyword(name) || name == "init" || name == "main" || taken[name] {
+		name += "_"
+	}
+	return name
+}
+
+func (this *goEmitter) emit(format string, args ...interface{}) {
+	fmt.Fprintf(this.w, format+"\n", args...)
+}
+
+func (this *goEmitter) operand(op operand) string {
+	if otype, val := op.unpack(); otype == operandType_CON {
+		return fmt.Sprintf("0x%x", this.proc.constants[val])
+	} else {
+		return this.regs[val]
+	}
+}
+
+// finds the registers whose values can reach a return, a branch or a
+// call. go rejects variables that are never read, so the others are not
+// declared and the assignments to them are left out.
+func (this *goEmitter) liveness(order []*BasicBlock) {
+	this.needed = map[int]bool{}
+	var worklist []int
+	need := func(op operand) {
+		if otype, val := op.unpack(); otype == operandType_REG && !this.needed[val] {
+			this.needed[val] = true
+			worklist = append(worklist, val)
+		}
+	}
+
+	// the instruction that defines a register and the arguments that the
+	// jumps pass to a parameter
+	defs := map[int]*Instruction{}
+	incoming := map[int][]operand{}
+	for _, blk := range order {
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			if insr.opcode == opcode_CALL {
+				for _, arg := range insr.arguments {
+					need(arg)
+				}
+			} else if otype, val := insr.operands[0].unpack(); otype == operandType_REG {
+				defs[val] = insr
+			}
+		}
+		if blk.jmpcode != opcode_JMP {
+			need(blk.jmpretval)
+		}
+		for i, succ := range blk.successors {
+			if succ != nil {
+				for j, val := range succ.ssaparams {
+					incoming[val] = append(incoming[val], blk.jmpargs[i][j])
+				}
+			}
+		}
+	}
+
+	for len(worklist) > 0 {
+		val := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		if insr, ok := defs[val]; ok {
+			need(insr.operands[1])
+			need(insr.operands[2])
+		}
+		for _, arg := range incoming[val] {
+			need(arg)
+		}
+	}
+}
+
+// names every ssa register after its local and generation
+func (this *goEmitter) names() {
+	taken := map[string]bool{}
+	for _, name := range this.funcs {
+		taken[name] = true
+	}
+
+	this.regs = make([]string, len(this.proc.ssaregs))
+	for i, reg := range this.proc.ssaregs {
+		if this.needed[i] || this.isParameter(i) {
+			name := goIdentifier(fmt.Sprintf("%s_%d", reg.local.name, reg.generation), taken)
+			taken[name] = true
+			this.regs[i] = name
+		} else {
+			this.regs[i] = "_"
+		}
+	}
+}
+
+func (this *goEmitter) isParameter(reg int) bool {
+	for _, val := range this.proc.entryPoint.ssaparams {
+		if val == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the result of insr is needed
+func (this *goEmitter) defines(insr *Instruction) bool {
+	otype, val := insr.operands[0].unpack()
+	return otype == operandType_REG && this.needed[val]
+}
+
+func (this *goEmitter) label(blk *BasicBlock) string {
+	return goIdentifier(blk.name, nil)
+}
+
+func (this *goEmitter) instruction(insr *Instruction) {
+	dst := this.operand(insr.operands[0])
+
+	switch insr.opcode {
+	case opcode_MOV:
+		if this.defines(insr) {
+			this.emit("%s = %s", dst, this.operand(insr.operands[1]))
+		}
+		return
+	case opcode_CALL:
+		var args []string
+		for _, arg := range insr.arguments {
+			args = append(args, this.operand(arg))
+		}
+		call := fmt.Sprintf("%s(%s)", this.funcs[insr.callee], strings.Join(args, ", "))
+		if !this.defines(insr) {
+			this.emit("%s", call)
+		} else {
+			this.emit("%s = %s", dst, call)
+		}
+		return
+	}
+
+	if !this.defines(insr) {
+		return
+	}
+
+	// constant expressions that overflow do not compile so fold them
+	a, b := insr.operands[1], insr.operands[2]
+	if a.otype == operandType_CON && b.otype == operandType_CON {
+		value := evaluate(insr.opcode, this.proc.constants[a.value], this.proc.constants[b.value])
+		this.emit("%s = 0x%x", dst, value)
+		return
+	}
+
+	switch insr.opcode {
+	case opcode_ADD:
+		this.emit("%s = %s + %s", dst, this.operand(a), this.operand(b))
+	case opcode_SUB:
+		this.emit("%s = %s - %s", dst, this.operand(a), this.operand(b))
+	case opcode_MUL:
+		this.emit("%s = %s * %s", dst, this.operand(a), this.operand(b))
+	case opcode_SHL:
+		if b.otype == operandType_CON {
+			this.emit("%s = %s << %d", dst, this.operand(a), this.proc.constants[b.value]&63)
+		} else {
+			this.emit("%s = %s << (%s & 63)", dst, this.operand(a), this.operand(b))
+		}
+	}
+}
+
+// assigns the jump arguments to the parameters of the successor in one
+// assignment, which reads all of them before writing any, and jumps to
+// the successor unless it is next
+func (this *goEmitter) jump(blk *BasicBlock, succidx int, next *BasicBlock) {
+	succ := blk.successors[succidx]
+	var params, args []string
+	for i, val := range succ.ssaparams {
+		if arg := this.operand(blk.jmpargs[succidx][i]); this.needed[val] && arg != this.regs[val] {
+			params = append(params, this.regs[val])
+			args = append(args, arg)
+		}
+	}
+	if len(params) > 0 {
+		this.emit("%s = %s", strings.Join(params, ", "), strings.Join(args, ", "))
+	}
+
+	if succ != next {
+		this.emit("goto %s", this.label(succ))
+	}
+}
+
+func (this *goEmitter) terminator(blk *BasicBlock, next *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		this.emit("return %s", this.operand(blk.jmpretval))
+	case opcode_JMP:
+		this.jump(blk, 0, next)
+	case opcode_JNZ:
+		this.emit("if %s != 0 {", this.operand(blk.jmpretval))
+		this.jump(blk, 0, nil)
+		this.emit("}")
+		this.jump(blk, 1, next)
+	}
+}
+
+func (this *goEmitter) procedure() error {
+	if err := checkCodegen(this.proc); err != nil {
+		return err
+	}
+
+	order := codegenOrder(this.proc)
+	this.liveness(order)
+	this.names()
+
+	// a label that is not jumped to does not compile
+	this.targets = map[*BasicBlock]bool{}
+	for i, blk := range order {
+		for j, succ := range blk.successors {
+			if succ != nil && (blk.jmpcode == opcode_JNZ && j == 0 || i+1 == len(order) || succ != order[i+1]) {
+				this.targets[succ] = true
+			}
+		}
+	}
+
+	var params []string
+	for _, val := range this.proc.entryPoint.ssaparams {
+		params = append(params, this.regs[val]+" uint64")
+	}
+	this.emit("func %s(%s) uint64 {", this.funcs[this.proc.name], strings.Join(params, ", "))
+
+	var vars []string
+	for i, name := range this.regs {
+		if this.needed[i] && !this.isParameter(i) {
+			vars = append(vars, name)
+		}
+	}
+	if len(vars) > 0 {
+		this.emit("var %s uint64", strings.Join(vars, ", "))
+	}
+
+	for i, blk := range order {
+		var next *BasicBlock
+		if i+1 < len(order) {
+			next = order[i+1]
+		}
+
+		if this.targets[blk] {
+			this.emit("%s:", this.label(blk))
+		}
+		for j, _ := range blk.instructions {
+			this.instruction(&blk.instructions[j])
+		}
+		this.terminator(blk, next)
+	}
+
+	this.emit("}")
+	return nil
+}
+
+// PrintGo writes mod as the source of the go package pkg with one func
+// per procedure. blocks become labels, jumps become gotos and the block
+// parameters become variables that are assigned at every jump. the
+// procedures must be in ssa form.
+func PrintGo(w io.Writer, mod *Module, pkg string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by cube. DO NOT EDIT.\n\npackage %s\n", pkg)
+
+	funcs := map[string]string{}
+	taken := map[string]bool{}
+	for _, proc := range mod.procedures {
+		funcs[proc.name] = goIdentifier(proc.name, taken)
+		taken[funcs[proc.name]] = true
+	}
+
+	for _, proc := range mod.procedures {
+		fmt.Fprintf(&buf, "\n")
+		if err := (&goEmitter{w: &buf, proc: proc, funcs: funcs}).procedure(); err != nil {
+			return err
+		}
+	}
+
+	if src, err := format.Source(buf.Bytes()); err != nil {
+		return err
+	} else {
+		_, err := w.Write(src)
+		return err
+	}
+}
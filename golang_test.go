@@ -0,0 +1,113 @@
+package cube
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+)
+
+func TestPrintGo(t *testing.T) {
+	expected := `// Code generated by cube. DO NOT EDIT.
+
+package gen
+
+func pow(b_0 uint64, e_0 uint64) uint64 {
+	var r_0, b_1, e_1, r_1, b_2, e_2, r_2, r_3, e_3, r_4 uint64
+	r_0 = 0x1
+	b_1, e_1, r_1 = b_0, e_0, r_0
+loop:
+	if e_1 != 0 {
+		b_2, e_2, r_2 = b_1, e_1, r_1
+		goto body
+	}
+	r_4 = r_1
+	goto done
+body:
+	r_3 = r_2 * b_2
+	e_3 = e_2 - 0x1
+	b_1, e_1, r_1 = b_2, e_3, r_3
+	goto loop
+done:
+	return r_4
+}
+`
+
+	var sb strings.Builder
+	err := Compile(&Config{
+		Source: livenessSource,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O0"); err != nil {
+				return err
+			}
+			return PrintGo(&sb, mod, "gen")
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if sb.String() != expected {
+		t.Fatal(sb.String())
+	}
+}
+
+func TestPrintGo_TypeCheck(t *testing.T) {
+	source := `
+	func type(x u64) u64 {
+		entry:
+			ret x
+	}
+
+	func main(a u64, b u64) u64 {
+		var dead u64
+		var t u64
+		var s u64
+		entry:
+			mov dead, a
+			mov t, 0
+			jmp loop
+		loop:
+			jnz b, body, done
+		body:
+			sub b, b, 1
+			shl t, t, a
+			add dead, dead, t
+			call s, type(t)
+			sub s, 0, 1
+			mul t, s, 0xffffffffffffffff
+			jmp loop
+		done:
+			ret t
+	}`
+
+	for _, pipeline := range []string{"-O0", "-O1", "-O2"} {
+		var sb strings.Builder
+		err := Compile(&Config{
+			Source: source,
+			Module: func(mod *Module) error {
+				if err := NewPassManager().RunModule(mod, pipeline); err != nil {
+					return err
+				}
+				return PrintGo(&sb, mod, "gen")
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "gen.go", sb.String(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := new(types.Config).Check("gen", fset, []*ast.File{file}, nil); err != nil {
+			t.Fatal(pipeline, err, sb.String())
+		} else if !strings.Contains(sb.String(), "func type_(") || !strings.Contains(sb.String(), "func main_(") {
+			t.Fatal(sb.String())
+		}
+	}
+}
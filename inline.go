@@ -0,0 +1,189 @@
+package cube
+
+import "fmt"
+
+// inliner splices the blocks of small callees into their callers.
+// both caller and callee must be in ssa form.
+type inliner struct {
+	module  *Module
+	maxsize int
+	count   int
+}
+
+func procedureSize(proc *Procedure) int {
+	size := 0
+	for _, blk := range proc.blocks {
+		size += len(blk.instructions) + 1
+	}
+	return size
+}
+
+// reports whether target can be reached from proc in the call graph
+func (this *inliner) reaches(proc, target *Procedure) bool {
+	visited := map[*Procedure]struct{}{}
+	var recurse func(*Procedure) bool
+	recurse = func(proc *Procedure) bool {
+		if _, hasvisited := visited[proc]; hasvisited {
+			return false
+		}
+		visited[proc] = struct{}{}
+		for _, blk := range proc.blocks {
+			for _, insr := range blk.instructions {
+				if insr.opcode == opcode_CALL {
+					if callee := this.module.lookup(insr.callee); callee == target {
+						return true
+					} else if callee != nil && recurse(callee) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	return recurse(proc)
+}
+
+func (this *inliner) shouldInline(caller, callee *Procedure) bool {
+	if callee == nil || len(callee.ssaregs) == 0 || procedureSize(callee) > this.maxsize {
+		return false
+	} else {
+		// never inline into a recursive cycle
+		return !this.reaches(callee, callee) && !this.reaches(callee, caller)
+	}
+}
+
+// returns the blocks added to proc
+func (this *inliner) inline(proc *Procedure, blk *BasicBlock, index int, callee *Procedure) []*BasicBlock {
+	this.count += 1
+	call := blk.instructions[index]
+
+	// the continuation receives the return value as its only parameter
+	cont := &BasicBlock{
+		name:         proc.newBlockName(blk.name),
+		instructions: append([]Instruction{}, blk.instructions[index+1:]...),
+		ssaparams:    []int{call.operands[0].value},
+		jmpcode:      blk.jmpcode,
+		jmpretval:    blk.jmpretval,
+		jmpargs:      blk.jmpargs,
+		successors:   blk.successors,
+	}
+
+	// rename the locals, registers and constants of the callee
+	localidxs := map[*Local]int{}
+	for i, local := range callee.locals {
+		local.name = fmt.Sprintf("%s%d_%s", callee.name, this.count, local.name)
+		local.isParameter = false
+		localidxs[&callee.locals[i]] = proc.addLocal(local)
+	}
+
+	ssaregidxs := make([]int, len(callee.ssaregs))
+	for i, ssareg := range callee.ssaregs {
+		ssaregidxs[i] = len(proc.ssaregs)
+		proc.ssaregs = append(proc.ssaregs, SSAReg{
+			local:      &proc.locals[localidxs[ssareg.local]],
+			generation: ssareg.generation,
+		})
+	}
+
+	rename := func(op operand) operand {
+		switch otype, val := op.unpack(); otype {
+		case operandType_REG:
+			return operandReg(ssaregidxs[val])
+		case operandType_CON:
+			return operandCon(proc.constant(callee.constants[val]))
+		default:
+			return op
+		}
+	}
+
+	proc.blocks = append(proc.blocks, cont)
+	result := []*BasicBlock{cont}
+
+	clones := map[*BasicBlock]*BasicBlock{}
+	for _, cblk := range callee.blocks {
+		clone := &BasicBlock{
+			name: proc.newBlockName(callee.name + "_" + cblk.name),
+		}
+		clones[cblk] = clone
+		proc.blocks = append(proc.blocks, clone)
+		result = append(result, clone)
+	}
+
+	for _, cblk := range callee.blocks {
+		clone := clones[cblk]
+
+		for _, val := range cblk.ssaparams {
+			clone.ssaparams = append(clone.ssaparams, ssaregidxs[val])
+		}
+
+		for _, insr := range cblk.instructions {
+			newinsr := Instruction{
+				opcode: insr.opcode,
+				callee: insr.callee,
+			}
+			for i, op := range insr.operands {
+				newinsr.operands[i] = rename(op)
+			}
+			for _, arg := range insr.arguments {
+				newinsr.arguments = append(newinsr.arguments, rename(arg))
+			}
+			clone.instructions = append(clone.instructions, newinsr)
+		}
+
+		if cblk.jmpcode == opcode_RET {
+			// ret becomes a jump to the continuation
+			clone.jmpcode = opcode_JMP
+			clone.successors[0] = cont
+			clone.jmpargs[0] = []operand{rename(cblk.jmpretval)}
+		} else {
+			clone.jmpcode = cblk.jmpcode
+			clone.jmpretval = rename(cblk.jmpretval)
+			for i, succ := range cblk.successors {
+				if succ != nil {
+					clone.successors[i] = clones[succ]
+					for _, a := range cblk.jmpargs[i] {
+						clone.jmpargs[i] = append(clone.jmpargs[i], rename(a))
+					}
+				}
+			}
+		}
+	}
+
+	// the call becomes a jump to the entry point passing the arguments
+	blk.instructions = blk.instructions[:index]
+	blk.jmpcode = opcode_JMP
+	blk.jmpretval = operandNil
+	blk.jmpargs = [2][]operand{call.arguments, nil}
+	blk.successors = [2]*BasicBlock{clones[callee.entryPoint], nil}
+
+	return result
+}
+
+func (this *inliner) run(proc *Procedure) *Procedure {
+	worklist := append([]*BasicBlock{}, proc.blocks...)
+
+	for len(worklist) > 0 {
+		blk := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		for i, insr := range blk.instructions {
+			if insr.opcode != opcode_CALL {
+				continue
+			} else if callee := this.module.lookup(insr.callee); this.shouldInline(proc, callee) {
+				worklist = append(worklist, this.inline(proc, blk, i, callee)...)
+				break
+			}
+		}
+	}
+
+	return Pass_BuildCFG(proc)
+}
+
+// Pass_Inline inlines every call to a non-recursive procedure of mod
+// whose size in instructions does not exceed maxsize.
+func Pass_Inline(proc *Procedure, mod *Module, maxsize int) *Procedure {
+	return (&inliner{
+		module:  mod,
+		maxsize: maxsize,
+	}).run(proc)
+}
@@ -0,0 +1,91 @@
+package cube
+
+import "testing"
+
+func TestInline_1(t *testing.T) {
+	source := `
+	func square(x u64) u64 {
+		var y u64
+		entry:
+			mul y, x, x
+			ret y
+	}
+
+	func fact(n u64) u64 {
+		var m u64
+		var r u64
+		entry:
+			jnz n, rec, done
+		rec:
+			sub m, n, 1
+			call r, fact(m)
+			mul r, r, n
+			ret r
+		done:
+			ret 1
+	}
+
+	func main(a u64) u64 {
+		var b u64
+		var c u64
+		entry:
+			call b, square(a)
+			call c, fact(b)
+			add c, c, 1
+			ret c
+	}`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Module: func(mod *Module) error {
+			for _, proc := range mod.procedures {
+				proc = Pass_BuildCFG(proc)
+				if _, err := reallycrudessa(proc); err != nil {
+					return err
+				}
+			}
+
+			main := Pass_Inline(mod.lookup("main"), mod, 16)
+
+			var callees []string
+			for _, blk := range main.blocks {
+				for _, insr := range blk.instructions {
+					if insr.opcode == opcode_CALL {
+						callees = append(callees, insr.callee)
+					}
+				}
+			}
+
+			if len(callees) != 1 || callees[0] != "fact" {
+				t.Fatalf("wrong calls after inlining: %v", callees)
+			} else if len(main.blocks) != 3 {
+				t.Fatalf("wrong nr of blocks")
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInline_UndefinedCallee(t *testing.T) {
+	source := `
+	func main(a u64) u64 {
+		var b u64
+		entry:
+			call b, missing(a)
+			ret b
+	}`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+	})
+
+	if err == nil || err.Error() != "test.cubeasm:5: call to undefined procedure missing" {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+)
+
+// calls may nest this deep by default, far less than the go stack allows
+const interpMaxDepth = 1 << 18
+
+// Interpreter executes the procedures of a module by walking their ir.
+// procedures may be in ssa form or not, and callers and callees may mix.
+type Interpreter struct {
+	Module *Module
+	// MaxSteps aborts a call after this many instructions if positive
+	MaxSteps int
+	// MaxDepth aborts a call when more than this many procedures are
+	// active at once if positive, because calls recurse in Go
+	MaxDepth int
+
+	steps int
+	depth int
+}
+
+func NewInterpreter(mod *Module) *Interpreter {
+	return &Interpreter{
+		Module:   mod,
+		MaxDepth: interpMaxDepth,
+	}
+}
+
+// Call runs the named procedure with args and returns its result
+func (this *Interpreter) Call(name string, args ...uint64) (uint64, error) {
+	this.steps = 0
+	this.depth = 0
+	if proc := this.Module.lookup(name); proc == nil {
+		return 0, errors.New(fmt.Sprintf("undefined procedure %s", name))
+	} else {
+		return this.call(proc, args)
+	}
+}
+
+type frame struct {
+	proc   *Procedure
+	locals []uint64
+	regs   []uint64
+}
+
+func (this *frame) read(op operand) uint64 {
+	switch otype, val := op.unpack(); otype {
+	case operandType_LOC:
+		return this.locals[val]
+	case operandType_REG:
+		return this.regs[val]
+	case operandType_CON:
+		return this.proc.constants[val]
+	default:
+		return 0
+	}
+}
+
+func (this *frame) write(op operand, value uint64) {
+	switch otype, val := op.unpack(); otype {
+	case operandType_LOC:
+		this.locals[val] = value
+	case operandType_REG:
+		this.regs[val] = value
+	}
+}
+
+// assigns the jump arguments to the parameters of the successor.
+// all arguments are read before any parameter is written.
+func (this *frame) jump(args []operand, succ *BasicBlock) {
+	values := make([]uint64, len(args))
+	for i, arg := range args {
+		values[i] = this.read(arg)
+	}
+	for i, val := range succ.ssaparams {
+		this.regs[val] = values[i]
+	}
+}
+
+// counts an executed instruction including terminators
+func (this *Interpreter) step(proc *Procedure) error {
+	if this.steps += 1; this.MaxSteps > 0 && this.steps > this.MaxSteps {
+		return errors.New(fmt.Sprintf("procedure %s exceeded %d steps", proc.name, this.MaxSteps))
+	}
+	return nil
+}
+
+func (this *Interpreter) call(proc *Procedure, args []uint64) (uint64, error) {
+	if this.depth += 1; this.MaxDepth > 0 && this.depth > this.MaxDepth {
+		return 0, errors.New(fmt.Sprintf("procedure %s exceeded the call depth of %d", proc.name, this.MaxDepth))
+	}
+	defer func() { this.depth -= 1 }()
+
+	if nparams := proc.numParameters(); nparams != len(args) {
+		return 0, errors.New(fmt.Sprintf("procedure %s takes %d arguments but %d were given", proc.name, nparams, len(args)))
+	} else if proc.entryPoint == nil {
+		return 0, errors.New(fmt.Sprintf("procedure %s has no entry point", proc.name))
+	}
+
+	frame := &frame{
+		proc:   proc,
+		locals: make([]uint64, len(proc.locals)),
+		regs:   make([]uint64, len(proc.ssaregs)),
+	}
+
+	blk := proc.entryPoint
+	if len(proc.ssaregs) > 0 {
+		for i, val := range blk.ssaparams {
+			frame.regs[val] = args[i]
+		}
+	} else {
+		copy(frame.locals, args)
+	}
+
+	for {
+		for _, insr := range blk.instructions {
+			if err := this.step(proc); err != nil {
+				return 0, err
+			}
+
+			switch insr.opcode {
+			case opcode_MOV:
+				frame.write(insr.operands[0], frame.read(insr.operands[1]))
+			case opcode_CALL:
+				if callee := this.Module.lookup(insr.callee); callee == nil {
+					return 0, errors.New(fmt.Sprintf("call to undefined procedure %s", insr.callee))
+				} else {
+					values := make([]uint64, len(insr.arguments))
+					for i, arg := range insr.arguments {
+						values[i] = frame.read(arg)
+					}
+					if result, err := this.call(callee, values); err != nil {
+						return 0, err
+					} else {
+						frame.write(insr.operands[0], result)
+					}
+				}
+			default:
+				a, b := frame.read(insr.operands[1]), frame.read(insr.operands[2])
+				frame.write(insr.operands[0], evaluate(insr.opcode, a, b))
+			}
+		}
+
+		if err := this.step(proc); err != nil {
+			return 0, err
+		}
+
+		succidx := 0
+		switch blk.jmpcode {
+		case opcode_RET:
+			return frame.read(blk.jmpretval), nil
+		case opcode_JMP:
+		case opcode_JNZ:
+			if frame.read(blk.jmpretval) == 0 {
+				succidx = 1
+			}
+		default:
+			return 0, errors.New(fmt.Sprintf("block %s in procedure %s has no terminator", blk, proc.name))
+		}
+
+		succ := blk.successors[succidx]
+		frame.jump(blk.jmpargs[succidx], succ)
+		blk = succ
+	}
+}
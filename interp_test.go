@@ -0,0 +1,105 @@
+package cube
+
+import "testing"
+
+func TestInterpreter_Call(t *testing.T) {
+	source := `
+	func square(x u64) u64 {
+		var y u64
+		entry:
+			mul y, x, x
+			ret y
+	}
+
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, square(b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}
+
+	func spin() u64 {
+		entry:
+			jmp entry
+	}`
+
+	for _, pipeline := range []string{"", "-O0", "-O1", "-O2"} {
+		err := Compile(&Config{
+			Source: source,
+			Module: func(mod *Module) error {
+				if pipeline != "" {
+					if err := NewPassManager().RunModule(mod, pipeline); err != nil {
+						return err
+					}
+				}
+
+				interp := NewInterpreter(mod)
+				interp.MaxSteps = 1000
+				if result, err := interp.Call("pow", 3, 4); err != nil || result != 6561 {
+					t.Fatal(pipeline, result, err)
+				} else if _, err := interp.Call("pow", 3); err == nil {
+					t.Fatal(pipeline)
+				} else if _, err := interp.Call("spin"); err == nil {
+					t.Fatal(pipeline)
+				} else if _, err := interp.Call("missing"); err == nil {
+					t.Fatal(pipeline)
+				}
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInterpreter_Depth(t *testing.T) {
+	source := `
+	func sum(n u64) u64 {
+		var m u64
+		entry:
+			jnz n, rec, done
+		rec:
+			sub m, n, 1
+			call m, sum(m)
+			add m, m, n
+			ret m
+		done:
+			ret 0
+	}`
+
+	err := Compile(&Config{
+		Source: source,
+		Module: func(mod *Module) error {
+			interp := NewInterpreter(mod)
+			if result, err := interp.Call("sum", 1000); err != nil || result != 500500 {
+				t.Fatal(result, err)
+			} else if _, err := interp.Call("sum", 1000000); err == nil {
+				t.Fatal("expected the default depth to be exceeded")
+			}
+
+			interp.MaxDepth = 10
+			if result, err := interp.Call("sum", 9); err != nil || result != 45 {
+				t.Fatal(result, err)
+			} else if _, err := interp.Call("sum", 10); err == nil || err.Error() != "procedure sum exceeded the call depth of 10" {
+				t.Fatal(err)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
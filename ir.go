@@ -3,19 +3,33 @@ package cube
 import "fmt"
 
 type Instruction struct {
-	opcode   *opcode
-	operands [3]operand
+	opcode    *opcode
+	operands  [3]operand
+	callee    string
+	arguments []operand
+	span      span
+}
+
+// calls fn with every operand read by the instruction
+func (this *Instruction) visitUses(fn func(op *operand)) {
+	for i, _ := range this.arguments {
+		fn(&this.arguments[i])
+	}
+	fn(&this.operands[1])
+	fn(&this.operands[2])
 }
 
 type BasicBlock struct {
 	name         string
+	span         span
 	instructions []Instruction
 
 	sccomponent  int
 	ssaparams    []int
 	jmpcode      *opcode
+	jmpspan      span
 	jmpretval    operand
-	jmpargs      [2][]int
+	jmpargs      [2][]operand
 	successors   [2]*BasicBlock
 	predecessors []*BasicBlock
 }
@@ -24,6 +38,24 @@ func (this *BasicBlock) String() string {
 	return this.name
 }
 
+// calls fn with every operand read by the block including its terminator
+func (this *BasicBlock) visitUses(fn func(op *operand)) {
+	for i, _ := range this.instructions {
+		this.instructions[i].visitUses(fn)
+	}
+	this.visitTerminatorUses(fn)
+}
+
+// calls fn with every operand read by the terminator of the block
+func (this *BasicBlock) visitTerminatorUses(fn func(op *operand)) {
+	fn(&this.jmpretval)
+	for i, _ := range this.jmpargs {
+		for j, _ := range this.jmpargs[i] {
+			fn(&this.jmpargs[i][j])
+		}
+	}
+}
+
 type Local struct {
 	name        string
 	dataType    *Type
@@ -31,6 +63,7 @@ type Local struct {
 	lastssareg  int
 	isParameter bool
 	isDefined   bool
+	span        span
 }
 
 func (this *Local) String() string {
@@ -43,7 +76,7 @@ type SSAReg struct {
 }
 
 func (this *SSAReg) String() string {
-	return fmt.Sprintf("%s%d", this.local.name, this.generation)
+	return fmt.Sprintf("%s.%d", this.local.name, this.generation)
 }
 
 type Procedure struct {
@@ -54,4 +87,120 @@ type Procedure struct {
 	ssaregs    []SSAReg
 	blocks     []*BasicBlock
 	entryPoint *BasicBlock
+	// the register allocator and the instruction scheduler that the
+	// pipeline selected, see registerAllocators and instructionSchedulers
+	regalloc string
+	schedule string
+	// the calling convention that the procedure was annotated with, or
+	// empty for the default, see callingConvNames
+	callconv string
+}
+
+func (this *Procedure) Name() string {
+	return this.name
+}
+
+// returns the name of the calling convention of the procedure
+func (this *Procedure) CallingConv() string {
+	if this.callconv == "" {
+		return callconv_DEFAULT
+	}
+	return this.callconv
+}
+
+func (this *Procedure) numParameters() int {
+	n := 0
+	for n < len(this.locals) && this.locals[n].isParameter {
+		n += 1
+	}
+	return n
+}
+
+func (this *Procedure) constant(num uint64) int {
+	for i, c := range this.constants {
+		if c == num {
+			return i
+		}
+	}
+
+	i := len(this.constants)
+	this.constants = append(this.constants, num)
+	return i
+}
+
+func (this *Procedure) addLocal(local Local) int {
+	index := len(this.locals)
+	oldlocals := this.locals
+	this.locals = append(this.locals, local)
+
+	// ssa registers point into the locals slice so rebind them if it moved
+	if index > 0 && &oldlocals[0] != &this.locals[0] {
+		for i, _ := range this.ssaregs {
+			for j, _ := range oldlocals {
+				if this.ssaregs[i].local == &oldlocals[j] {
+					this.ssaregs[i].local = &this.locals[j]
+					break
+				}
+			}
+		}
+	}
+
+	return index
+}
+
+// returns the type of the local or register op, or nil for constants
+// which take the type they are used as
+func (this *Procedure) operandType(op operand) *Type {
+	switch otype, val := op.unpack(); otype {
+	case operandType_LOC:
+		return this.locals[val].dataType
+	case operandType_REG:
+		return this.ssaregs[val].local.dataType
+	default:
+		return nil
+	}
+}
+
+// returns a block name derived from name that is not used by any block
+func (this *Procedure) newBlockName(name string) string {
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s_%d", name, n)
+		unique := true
+		for _, blk := range this.blocks {
+			if blk.name == candidate {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			return candidate
+		}
+	}
+}
+
+func (this *Procedure) newSSAReg(local *Local) int {
+	ssaregidx := len(this.ssaregs)
+	this.ssaregs = append(this.ssaregs, SSAReg{
+		local:      local,
+		generation: local.generations,
+	})
+	local.generations += 1
+	return ssaregidx
+}
+
+type Module struct {
+	procedures []*Procedure
+}
+
+func (this *Module) Procedures() []*Procedure {
+	return this.procedures
+}
+
+func (this *Module) lookup(name string) *Procedure {
+	for _, proc := range this.procedures {
+		if proc.name == name {
+			return proc
+		}
+	}
+	return nil
 }
@@ -0,0 +1,228 @@
+package cube
+
+import "fmt"
+
+type treeKind int
+
+const (
+	tree_NODE treeKind = iota
+	tree_REG
+	tree_CON
+)
+
+// a treePattern matches an ir instruction and recursively the
+// instructions that define its operands. at the leaves it matches any
+// operand, which is brought into a register, or a constant that satisfies
+// pred.
+type treePattern struct {
+	kind   treeKind
+	opcode *opcode
+	args   []*treePattern
+	pred   func(value uint64) bool
+}
+
+// matches an instruction whose operands match args
+func tree(opc *opcode, args ...*treePattern) *treePattern {
+	return &treePattern{kind: tree_NODE, opcode: opc, args: args}
+}
+
+// matches any operand in a register
+var leafReg = &treePattern{kind: tree_REG}
+
+// matches a constant for which pred holds, or any constant if pred is nil
+func leafCon(pred func(value uint64) bool) *treePattern {
+	return &treePattern{kind: tree_CON, pred: pred}
+}
+
+// an iselRule emits the machine instructions that compute the ir tree
+// matched by pattern into dst. args holds the operands at the leaves of
+// the pattern from left to right, virtual registers for register leaves
+// and constants for constant leaves.
+type iselRule struct {
+	pattern *treePattern
+	emit    func(sel *selector, dst operand, args []operand)
+}
+
+// an operand bound to a leaf of a pattern
+type iselBinding struct {
+	leaf *treePattern
+	op   operand
+}
+
+// selector tiles the trees of every block with the rules of a target by
+// maximal munch. the rules are tried in order so targets list the larger
+// tiles first.
+type selector struct {
+	mp    *machineProc
+	rules []iselRule
+	block *machineBlock
+	// the instructions that are folded into their single user
+	foldable map[int]*Instruction
+}
+
+func (this *selector) constant(op operand) uint64 {
+	return this.mp.proc.constants[op.value]
+}
+
+// appends a machine instruction to the current block
+func (this *selector) emit(opc *machineOpcode, dst operand, imm int64, srcs ...operand) {
+	this.block.instrs = append(this.block.instrs, &machineInstr{
+		opcode: opc,
+		dst:    dst,
+		srcs:   srcs,
+		imm:    imm,
+	})
+}
+
+func isBinary(opc *opcode) bool {
+	return opc == opcode_ADD || opc == opcode_SUB || opc == opcode_MUL || opc == opcode_SHL
+}
+
+// finds the registers that are defined by an arithmetic instruction and
+// used once by another in the same block. their instructions become
+// inner nodes of the tree of their user. the value of an ssa register
+// never changes so moving its computation down to its user is safe.
+func (this *selector) findFoldable(order []*BasicBlock) {
+	uses := map[int]int{}
+	count := func(op *operand) {
+		if otype, val := op.unpack(); otype == operandType_REG {
+			uses[val] += 1
+		}
+	}
+	for _, blk := range order {
+		for i, _ := range blk.instructions {
+			blk.instructions[i].visitUses(count)
+		}
+		blk.visitTerminatorUses(count)
+	}
+
+	this.foldable = map[int]*Instruction{}
+	for _, blk := range order {
+		defs := map[int]*Instruction{}
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			if isBinary(insr.opcode) {
+				for _, op := range insr.operands[1:] {
+					if otype, val := op.unpack(); otype == operandType_REG && uses[val] == 1 && defs[val] != nil {
+						this.foldable[val] = defs[val]
+					}
+				}
+				if otype, val := insr.operands[0].unpack(); otype == operandType_REG {
+					defs[val] = insr
+				}
+			}
+		}
+	}
+}
+
+// matches p against op and collects the operands at the leaves
+func (this *selector) matchOperand(p *treePattern, op operand, leaves *[]iselBinding) bool {
+	otype, val := op.unpack()
+	switch p.kind {
+	case tree_REG:
+		*leaves = append(*leaves, iselBinding{p, op})
+		return true
+	case tree_CON:
+		if otype != operandType_CON || p.pred != nil && !p.pred(this.mp.proc.constants[val]) {
+			return false
+		}
+		*leaves = append(*leaves, iselBinding{p, op})
+		return true
+	default:
+		if insr, ok := this.foldable[val]; otype == operandType_REG && ok {
+			return this.matchInstr(p, insr, leaves)
+		}
+		return false
+	}
+}
+
+func (this *selector) matchInstr(p *treePattern, insr *Instruction, leaves *[]iselBinding) bool {
+	if p.kind != tree_NODE || p.opcode != insr.opcode {
+		return false
+	}
+	for i, arg := range p.args {
+		if !this.matchOperand(arg, insr.operands[1+i], leaves) {
+			return false
+		}
+	}
+	return true
+}
+
+// brings the operand of a leaf into a virtual register if the leaf
+// wants a register. constants are loaded into a temporary by the rules
+// of the target for mov and the instructions that are not folded into
+// the tile are selected now.
+func (this *selector) reduce(b iselBinding) operand {
+	if b.leaf.kind != tree_REG {
+		return b.op
+	} else if otype, val := b.op.unpack(); otype == operandType_CON {
+		tmp := this.mp.newTemp()
+		this.selectInstr(&Instruction{
+			opcode:   opcode_MOV,
+			operands: [3]operand{tmp, b.op, operand{}},
+		})
+		return tmp
+	} else if insr, ok := this.foldable[val]; ok {
+		this.selectInstr(insr)
+	}
+	return b.op
+}
+
+func (this *selector) selectInstr(insr *Instruction) {
+	if insr.opcode == opcode_CALL {
+		this.block.instrs = append(this.block.instrs, &machineInstr{
+			opcode: machine_CALL,
+			dst:    insr.operands[0],
+			srcs:   insr.arguments,
+			ir:     insr,
+		})
+		return
+	} else if insr.opcode == opcode_MOV && insr.operands[1].otype != operandType_CON {
+		this.emit(machine_MOV, insr.operands[0], 0, insr.operands[1])
+		return
+	}
+
+	for _, rule := range this.rules {
+		var leaves []iselBinding
+		if this.matchInstr(rule.pattern, insr, &leaves) {
+			args := make([]operand, len(leaves))
+			for i, b := range leaves {
+				args[i] = this.reduce(b)
+			}
+			rule.emit(this, insr.operands[0], args)
+			return
+		}
+	}
+
+	panic(fmt.Sprintf("no rule matches %s", insr.opcode.name))
+}
+
+// selectInstructions lowers the reachable blocks of proc in order to
+// machine instructions with rules. every tree of a block is covered by
+// the first rule that matches at its root and the operands at the leaves
+// of the rule are covered in turn. the rules must cover every arithmetic
+// opcode with registers at the leaves and mov with any constant.
+func selectInstructions(proc *Procedure, order []*BasicBlock, rules []iselRule) *machineProc {
+	sel := &selector{
+		mp: &machineProc{
+			proc:   proc,
+			nvregs: len(proc.ssaregs),
+		},
+		rules: rules,
+	}
+	sel.findFoldable(order)
+
+	for _, blk := range order {
+		sel.block = &machineBlock{block: blk}
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			if otype, val := insr.operands[0].unpack(); otype == operandType_REG && sel.foldable[val] == insr {
+				continue
+			}
+			sel.selectInstr(insr)
+		}
+		sel.mp.blocks = append(sel.mp.blocks, sel.block)
+	}
+
+	return sel.mp
+}
@@ -0,0 +1,85 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectInstructions(t *testing.T) {
+	source := `
+	func mac(a u64, b u64, c u64) u64 {
+		var p u64
+		var q u64
+		var s u64
+		entry:
+			mul p, b, c
+			add s, a, p
+			shl q, b, 3
+			sub s, s, q
+			ret s
+	}
+
+	func twice(a u64, b u64) u64 {
+		var p u64
+		entry:
+			mul p, a, b
+			add p, p, p
+			sub p, 0, p
+			ret p
+	}
+
+	func far(a u64) u64 {
+		entry:
+			add a, a, 0x12345
+			ret a
+	}
+
+	func index(a u64, b u64) u64 {
+		var q u64
+		entry:
+			shl q, b, 3
+			add a, a, q
+			mul a, a, 10
+			ret a
+	}`
+
+	for _, testcase := range []struct {
+		name     string
+		rules    []iselRule
+		expected string
+	}{
+		// the multiplication and the shift are folded into their user
+		{"mac", aarch64Rules, "entry(a.0, b.0, c.0):\n\tmadd s.0, b.0, c.0, a.0\n\tsub s.1, s.0, b.0, lsl #3\n\tret s.1\n"},
+		{"mac", riscv64Rules, "entry(a.0, b.0, c.0):\n\tmul p.0, b.0, c.0\n\tadd s.0, a.0, p.0\n\tslli q.0, b.0, 3\n\tsub s.1, s.0, q.0\n\tret s.1\n"},
+		// values with more than one use are not folded
+		{"twice", aarch64Rules, "entry(a.0, b.0):\n\tmul p.0, a.0, b.0\n\tadd p.1, p.0, p.0\n\tneg p.2, p.1\n\tret p.2\n"},
+		// constants that do not fit an immediate go to a temporary
+		{"far", riscv64Rules, "entry(a.0):\n\tlui t0, 0x12\n\taddiw t0, t0, 837\n\tadd a.1, a.0, t0\n\tret a.1\n"},
+		// a shift by up to three folds into the index of an address
+		{"index", amd64Rules, "entry(a.0, b.0):\n\tlea a.1, [a.0+b.0*8]\n\timul a.2, a.1, 10\n\tret a.2\n"},
+	} {
+		var text string
+		err := Compile(&Config{
+			Source: source,
+			Procedure: func(proc *Procedure) error {
+				if proc.name != testcase.name {
+					return nil
+				}
+				proc, err := NewPassManager().Run(proc, "-O1")
+				if err != nil {
+					return err
+				}
+				var sb strings.Builder
+				printMachineProc(&sb, selectInstructions(proc, codegenOrder(proc), testcase.rules))
+				text = sb.String()
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		} else if text != testcase.expected {
+			t.Fatal(testcase.name, text)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+)
+
+// JIT compiles the procedures of mod to native code and returns the
+// procedure called name as a Go function. the procedures must be in ssa
+// form. the function panics if it is called with the wrong number of
+// arguments or if the procedure overflows the stack. on platforms without
+// a native code generator the function runs the procedure with the
+// Interpreter instead.
+func JIT(mod *Module, name string) (func(args ...uint64) uint64, error) {
+	proc := mod.lookup(name)
+	if proc == nil {
+		return nil, errors.New(fmt.Sprintf("undefined procedure %s", name))
+	}
+
+	fn, err := jit(mod, proc)
+	if err != nil {
+		return nil, err
+	}
+
+	nparams := proc.numParameters()
+	return func(args ...uint64) uint64 {
+		if len(args) != nparams {
+			panic(fmt.Sprintf("procedure %s takes %d arguments but %d were given", name, nparams, len(args)))
+		}
+		return fn(args)
+	}, nil
+}
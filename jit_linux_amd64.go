@@ -0,0 +1,136 @@
+//go:build linux && amd64
+
+package cube
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// native code runs on a stack of its own since goroutine stacks are small
+// and cannot grow while it runs. the lowest page is a guard page.
+const jitStackSize = 8 << 20
+
+// the jit state is the page after the text, the only one that stays
+// writable. prologues compare rsp with its first word, which leaves room
+// above the guard page for the return address and rbp that a callee
+// pushes before its check. the overflow stub unwinds to the outermost
+// call, so jitcall keeps the stack and frame pointers of go in it.
+const (
+	jitstate_LIMIT    = 0
+	jitstate_RESUME   = 8
+	jitstate_GOSP     = 16
+	jitstate_GOBP     = 24
+	jitstate_OVERFLOW = 32
+
+	jitStackMargin = 64
+)
+
+// calls the native function fn with the system v calling convention on
+// the stack whose top is stack. args must hold at least six values of
+// which nargs are passed. state is the jit state.
+func jitcall(fn uintptr, args *uint64, nargs int, stack uintptr, state uintptr) uint64
+
+// emits the procedure that prologues jump to when the stack is exhausted.
+// it sets the overflow word of the jit state and returns from the
+// outermost call with the stack pointer that jitcall saved.
+func emitStackOverflow(code *objectCode) {
+	emitter := &amd64Emitter{code: code}
+	start := len(code.text)
+
+	// lea r12, [jitstate], mov rsp, [r12+resume], mov [r12+overflow], 1, ret
+	emitter.ripRelative(12, amd64_JITSTATE, 0x8d)
+	emitter.rm(amd64_RSP, 12, jitstate_RESUME, 0x8b)
+	emitter.rm(0, 12, jitstate_OVERFLOW, 0xc7)
+	emitter.imm32(1)
+	emitter.bytes(0xc3)
+
+	code.symbols = append(code.symbols, objectSymbol{
+		name:   amd64_STACKOVERFLOW,
+		offset: start,
+		size:   len(code.text) - start,
+	})
+}
+
+// the executable memory and the stack of compiled code
+type jitCode struct {
+	mu    sync.Mutex
+	text  []byte
+	stack []byte
+}
+
+func (this *jitCode) free() {
+	syscall.Munmap(this.text)
+	syscall.Munmap(this.stack)
+}
+
+func jit(mod *Module, proc *Procedure) (func(args []uint64) uint64, error) {
+	code, err := encodeAMD64(mod, true)
+	if err != nil {
+		return nil, err
+	}
+	emitStackOverflow(code)
+
+	pagesize := syscall.Getpagesize()
+	size := (len(code.text) + pagesize - 1) &^ (pagesize - 1)
+
+	// every callee is in the module, so the calls are resolved here
+	for _, reloc := range code.relocations {
+		target := size
+		if reloc.symbol != amd64_JITSTATE {
+			target = code.lookup(reloc.symbol).offset
+		}
+		disp := target - (reloc.offset + 4)
+		binary.LittleEndian.PutUint32(code.text[reloc.offset:], uint32(int32(disp)))
+	}
+
+	text, err := syscall.Mmap(-1, 0, size+pagesize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(text, code.text)
+	if err := syscall.Mprotect(text[:size], syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		syscall.Munmap(text)
+		return nil, err
+	}
+
+	stack, err := syscall.Mmap(-1, 0, jitStackSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		syscall.Munmap(text)
+		return nil, err
+	} else if err := syscall.Mprotect(stack[:pagesize], syscall.PROT_NONE); err != nil {
+		syscall.Munmap(text)
+		syscall.Munmap(stack)
+		return nil, err
+	}
+
+	jc := &jitCode{text: text, stack: stack}
+	runtime.SetFinalizer(jc, (*jitCode).free)
+
+	entry := uintptr(unsafe.Pointer(&text[0])) + uintptr(code.lookup(proc.name).offset)
+	top := uintptr(unsafe.Pointer(&stack[0])) + jitStackSize
+	limit := uintptr(unsafe.Pointer(&stack[pagesize])) + jitStackMargin
+
+	state := text[size:]
+	binary.LittleEndian.PutUint64(state[jitstate_LIMIT:], uint64(limit))
+
+	return func(args []uint64) uint64 {
+		regs := make([]uint64, len(args)+len(amd64CallingConvs[callconv_DEFAULT].argRegs))
+		copy(regs, args)
+
+		// calls share the stack and the state so they take turns
+		jc.mu.Lock()
+		defer jc.mu.Unlock()
+		result := jitcall(entry, &regs[0], len(args), top, uintptr(unsafe.Pointer(&state[0])))
+		if binary.LittleEndian.Uint64(state[jitstate_OVERFLOW:]) != 0 {
+			panic(errors.New(fmt.Sprintf("procedure %s overflowed the stack of %d bytes", proc.name, jitStackSize)))
+		}
+		return result
+	}, nil
+}
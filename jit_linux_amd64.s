@@ -0,0 +1,55 @@
+//go:build linux && amd64
+
+#include "textflag.h"
+
+// func jitcall(fn uintptr, args *uint64, nargs int, stack uintptr, state uintptr) uint64
+TEXT ·jitcall(SB), NOSPLIT, $0-48
+	MOVQ fn+0(FP), AX
+	MOVQ args+8(FP), R10
+	MOVQ nargs+16(FP), CX
+	MOVQ stack+24(FP), R11
+
+	// r12 holds the state, it is callee saved in the system v abi and
+	// the overflow stub sets it again. the stack and frame pointers of
+	// go are kept in the state since the stub unwinds without restoring
+	// any other register.
+	MOVQ state+32(FP), R12
+	MOVQ SP, 16(R12)
+	MOVQ BP, 24(R12)
+	MOVQ $0, 32(R12)
+	MOVQ R11, SP
+
+	// push the stack arguments from last to first and keep the stack
+	// aligned to 16 bytes at the call
+	MOVQ CX, R13
+	SUBQ $6, R13
+	JLE registers
+	TESTQ $1, R13
+	JZ push
+	SUBQ $8, SP
+
+push:
+	MOVQ -8(R10)(CX*8), R11
+	SUBQ $8, SP
+	MOVQ R11, 0(SP)
+	DECQ CX
+	DECQ R13
+	JNZ push
+
+registers:
+	// the stub resumes at the return address of the call
+	LEAQ -8(SP), R11
+	MOVQ R11, 8(R12)
+
+	MOVQ 0(R10), DI
+	MOVQ 8(R10), SI
+	MOVQ 16(R10), DX
+	MOVQ 24(R10), CX
+	MOVQ 32(R10), R8
+	MOVQ 40(R10), R9
+	CALL AX
+
+	MOVQ 16(R12), SP
+	MOVQ 24(R12), BP
+	MOVQ AX, ret+40(FP)
+	RET
@@ -0,0 +1,18 @@
+//go:build !(linux && amd64)
+
+package cube
+
+// without a native code generator the interpreter runs the procedure
+func jit(mod *Module, proc *Procedure) (func(args []uint64) uint64, error) {
+	if err := checkCodegen(proc); err != nil {
+		return nil, err
+	}
+
+	return func(args []uint64) uint64 {
+		if result, err := NewInterpreter(mod).Call(proc.name, args...); err != nil {
+			panic(err)
+		} else {
+			return result
+		}
+	}, nil
+}
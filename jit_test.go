@@ -0,0 +1,177 @@
+package cube
+
+import "testing"
+
+func TestJIT(t *testing.T) {
+	source := `
+	func nine(a u64, b u64, c u64, d u64, e u64, f u64, g u64, h u64, i u64) u64 {
+		var r u64
+		entry:
+			sub r, a, i
+			shl r, r, h
+			ret r
+	}
+
+	func fib(n u64) u64 {
+		var a u64
+		var b u64
+		var m u64
+		entry:
+			jnz n, rec, done
+		rec:
+			sub m, n, 1
+			jnz m, more, done
+		more:
+			call a, fib(m)
+			sub m, m, 1
+			call b, fib(m)
+			add a, a, b
+			ret a
+		done:
+			ret n
+	}
+
+	func big(x u64) u64 {
+		var r u64
+		entry:
+			mul r, x, 0x123456789abcdef
+			add r, r, 0xffffffff80000000
+			ret r
+	}`
+
+	tests := []struct {
+		name string
+		args []uint64
+	}{
+		{"nine", []uint64{100, 0, 0, 0, 0, 0, 0, 2, 1}},
+		{"fib", []uint64{20}},
+		{"big", []uint64{3}},
+	}
+
+	for _, pipeline := range []string{"-O0", "-O1", "-O2"} {
+		err := Compile(&Config{
+			Source: source,
+			Module: func(mod *Module) error {
+				if err := NewPassManager().RunModule(mod, pipeline); err != nil {
+					return err
+				}
+
+				for _, test := range tests {
+					fn, err := JIT(mod, test.name)
+					if err != nil {
+						return err
+					}
+					expected, err := NewInterpreter(mod).Call(test.name, test.args...)
+					if err != nil {
+						return err
+					}
+					if result := fn(test.args...); result != expected {
+						t.Fatal(pipeline, test.name, result, expected)
+					}
+				}
+
+				if _, err := JIT(mod, "missing"); err == nil {
+					t.Fatal("expected an error")
+				}
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(pipeline, err)
+		}
+	}
+}
+
+func TestEncodeAMD64(t *testing.T) {
+	err := Compile(&Config{
+		Source: `
+		func big() u64 {
+			entry:
+				ret 0x1234000000005678
+		}
+
+		func caller() u64 {
+			var r u64
+			entry:
+				call r, big()
+				ret r
+		}`,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O0"); err != nil {
+				return err
+			}
+
+			code, err := encodeAMD64(mod, false)
+			if err != nil {
+				return err
+			}
+
+			// push rbp, mov rbp, rsp, movabs rax, imm64, leave, ret
+			expected := "\x55\x48\x89\xe5\x48\xb8\x78\x56\x00\x00\x00\x00\x34\x12\xc9\xc3"
+			if sym := code.lookup("big"); sym == nil || string(code.text[sym.offset:sym.offset+sym.size]) != expected {
+				t.Fatalf("% x", code.text)
+			}
+
+			caller := code.lookup("caller")
+			if len(code.relocations) != 1 || code.relocations[0].symbol != "big" || code.text[code.relocations[0].offset-1] != 0xe8 {
+				t.Fatal(code.relocations)
+			} else if reloc := code.relocations[0].offset; reloc < caller.offset || reloc >= caller.offset+caller.size {
+				t.Fatal(reloc)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJIT_StackOverflow(t *testing.T) {
+	source := `
+	func sum(n u64) u64 {
+		var m u64
+		entry:
+			jnz n, rec, done
+		rec:
+			sub m, n, 1
+			call m, sum(m)
+			add m, m, n
+			ret m
+		done:
+			ret 0
+	}`
+
+	err := Compile(&Config{
+		Source: source,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O0"); err != nil {
+				return err
+			}
+
+			fn, err := JIT(mod, "sum")
+			if err != nil {
+				return err
+			}
+
+			call := func(n uint64) (result uint64, err interface{}) {
+				defer func() {
+					err = recover()
+				}()
+				return fn(n), nil
+			}
+
+			if _, err := call(100000000); err == nil {
+				t.Fatal("expected the stack to overflow")
+			} else if result, err := call(1000); err != nil || result != 500500 {
+				t.Fatal(result, err)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
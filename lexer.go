@@ -3,6 +3,7 @@ package cube
 import (
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 func isbindigit(ch rune) bool {
@@ -20,13 +21,14 @@ func ishexdigit(ch rune) bool {
 const eof rune = 0
 
 type Lexer struct {
-	reader   *strings.Reader
-	source   string
-	peek     rune
-	peekw    int
-	lineno   int
-	initial  int
-	position int
+	reader    *strings.Reader
+	source    string
+	peek      rune
+	peekw     int
+	lineno    int
+	linestart int
+	initial   int
+	position  int
 }
 
 func NewLexer(source string) *Lexer {
@@ -45,6 +47,8 @@ func (this *Lexer) token(tokenType TokenType) Token {
 	return Token{
 		Type:   tokenType,
 		LineNo: this.lineno,
+		Column: utf8.RuneCountInString(this.source[this.linestart:this.initial]) + 1,
+		Offset: this.initial,
 		Value:  this.source[this.initial:this.position],
 	}
 }
@@ -95,6 +99,7 @@ func (this *Lexer) whitespace() {
 		switch this.peek {
 		case '\n':
 			this.lineno += 1
+			this.linestart = this.position + 1
 			fallthrough
 		case '\v':
 			fallthrough
@@ -125,12 +130,14 @@ var keywords = []struct {
 }{
 	// must be in alphabetical order
 	{"add", ADD},
+	{"call", CALL},
 	{"func", FUNC},
 	{"jmp", JMP},
 	{"jnz", JNZ},
 	{"mov", MOV},
 	{"mul", MUL},
 	{"ret", RET},
+	{"shl", SHL},
 	{"sub", SUB},
 	{"u64", U64},
 	{"var", VAR},
@@ -183,6 +190,8 @@ func (this *Lexer) Scan() Token {
 		return this.token(COMMA)
 	case ':':
 		return this.token(COLON)
+	case '.':
+		return this.token(DOT)
 	case '-':
 		if !isdecdigit(this.peek) {
 			return this.token(ILLEGAL)
@@ -37,6 +37,8 @@ func TestScanKeywords(t *testing.T) {
 		mul
 		var
 		ret
+		call
+		shl
 	`)
 
 	tokens := []TokenType{
@@ -50,6 +52,8 @@ func TestScanKeywords(t *testing.T) {
 		MUL,
 		VAR,
 		RET,
+		CALL,
+		SHL,
 	}
 
 	for _, expected := range tokens {
@@ -114,3 +118,34 @@ func TestScanMisc(t *testing.T) {
 		}
 	}
 }
+
+func TestScanPositions(t *testing.T) {
+	lexer := NewLexer("func f() u64 {\n\tentry: ; ë\n  ret 0x1\n}")
+
+	positions := []struct {
+		value  string
+		lineno int
+		column int
+		offset int
+	}{
+		{"func", 1, 1, 0},
+		{"f", 1, 6, 5},
+		{"(", 1, 7, 6},
+		{")", 1, 8, 7},
+		{"u64", 1, 10, 9},
+		{"{", 1, 14, 13},
+		{"entry", 2, 2, 16},
+		{":", 2, 7, 21},
+		{"ret", 3, 3, 30},
+		{"0x1", 3, 7, 34},
+		{"}", 4, 1, 38},
+	}
+
+	for _, expected := range positions {
+		token := lexer.Scan()
+		if token.Value != expected.value || token.LineNo != expected.lineno ||
+			token.Column != expected.column || token.Offset != expected.offset {
+			t.Fatal(token)
+		}
+	}
+}
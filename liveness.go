@@ -0,0 +1,148 @@
+package cube
+
+// liveness holds the variables that are live at the boundaries of every
+// reachable block. variables are locals before ssa construction and ssa
+// registers after.
+type liveness struct {
+	proc      *Procedure
+	isssa     bool
+	nvars     int
+	livein    map[*BasicBlock]bitset
+	liveout   map[*BasicBlock]bitset
+	livestart map[*BasicBlock]bitset
+}
+
+func (this *liveness) variable(op operand) (int, bool) {
+	if this.isssa {
+		return op.value, op.otype == operandType_REG
+	} else {
+		return op.value, op.otype == operandType_LOC
+	}
+}
+
+// marks the variables read by insr as live and its destination as dead
+func (this *liveness) transfer(live bitset, insr *Instruction) {
+	if v, ok := this.variable(insr.operands[0]); ok {
+		live.clear(v)
+	}
+	insr.visitUses(func(op *operand) {
+		if v, ok := this.variable(*op); ok {
+			live.set(v)
+		}
+	})
+}
+
+func (this *liveness) terminator(live bitset, blk *BasicBlock) {
+	blk.visitTerminatorUses(func(op *operand) {
+		if v, ok := this.variable(*op); ok {
+			live.set(v)
+		}
+	})
+}
+
+// computes the variables that are live at the start of blk after its
+// parameters are defined, given the variables live at its end
+func (this *liveness) block(blk *BasicBlock, liveout bitset) bitset {
+	live := liveout.copy()
+	this.terminator(live, blk)
+	for i := len(blk.instructions) - 1; i >= 0; i-- {
+		this.transfer(live, &blk.instructions[i])
+	}
+	return live
+}
+
+func computeLiveness(proc *Procedure) *liveness {
+	this := &liveness{
+		proc:      proc,
+		isssa:     len(proc.ssaregs) > 0,
+		livestart: map[*BasicBlock]bitset{},
+	}
+
+	if this.isssa {
+		this.nvars = len(proc.ssaregs)
+	} else {
+		this.nvars = len(proc.locals)
+	}
+
+	result := solveDataflow(proc, &dataflowProblem{
+		direction: dataflow_BACKWARD,
+		boundary:  newBitset(this.nvars),
+		initial:   newBitset(this.nvars),
+		join:      joinUnion,
+		transfer: func(blk *BasicBlock, liveout bitset) bitset {
+			livein := this.block(blk, liveout)
+			for _, val := range blk.ssaparams {
+				livein.clear(val)
+			}
+			return livein
+		},
+	})
+
+	this.livein = result.in
+	this.liveout = result.out
+	for blk, liveout := range this.liveout {
+		this.livestart[blk] = this.block(blk, liveout)
+	}
+
+	return this
+}
+
+// returns the variables that are live after each instruction of blk
+func (this *liveness) liveAfter(blk *BasicBlock) []bitset {
+	result := make([]bitset, len(blk.instructions))
+	live := this.liveout[blk].copy()
+	this.terminator(live, blk)
+	for i := len(blk.instructions) - 1; i >= 0; i-- {
+		result[i] = live.copy()
+		this.transfer(live, &blk.instructions[i])
+	}
+	return result
+}
+
+// Pass_PruneParams removes the block parameters that are dead on entry to
+// their block and the matching arguments of every jump. parameters that are
+// only passed around a loop stay live. the procedure must be in ssa form.
+func Pass_PruneParams(proc *Procedure) *Procedure {
+	for changed := true; changed; {
+		changed = false
+		live := computeLiveness(proc)
+
+		for _, blk := range proc.blocks {
+			if blk == proc.entryPoint {
+				continue
+			}
+
+			var keep []bool
+			var params []int
+			for _, val := range blk.ssaparams {
+				keep = append(keep, live.livestart[blk].has(val))
+				if live.livestart[blk].has(val) {
+					params = append(params, val)
+				}
+			}
+
+			if len(params) == len(blk.ssaparams) {
+				continue
+			}
+
+			blk.ssaparams = params
+			changed = true
+
+			for _, pred := range proc.blocks {
+				for i, succ := range pred.successors {
+					if succ == blk {
+						var args []operand
+						for j, arg := range pred.jmpargs[i] {
+							if keep[j] {
+								args = append(args, arg)
+							}
+						}
+						pred.jmpargs[i] = args
+					}
+				}
+			}
+		}
+	}
+
+	return proc
+}
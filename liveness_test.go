@@ -0,0 +1,106 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+const livenessSource = `
+	func pow(b u64, e u64) u64 {
+	var r u64
+	var t u64
+	entry:
+		mov r, 1
+		mov t, 5
+		jmp loop
+	loop:
+		jnz e, body, done
+	body:
+		mul r, r, b
+		sub e, e, 1
+		jmp loop
+	done:
+		ret r
+	}`
+
+func TestLiveness_Locals(t *testing.T) {
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   livenessSource,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			live := computeLiveness(proc)
+			expected := map[string][]int{
+				"entry": {0, 1},
+				"loop":  {0, 1, 2},
+				"body":  {0, 1, 2},
+				"done":  {2},
+			}
+			for _, blk := range proc.blocks {
+				var got []int
+				live.livein[blk].each(func(i int) {
+					got = append(got, i)
+				})
+				if len(got) != len(expected[blk.name]) {
+					t.Fatalf("wrong live-in set for %s: %v", blk, got)
+				}
+				for i, v := range got {
+					if expected[blk.name][i] != v {
+						t.Fatalf("wrong live-in set for %s: %v", blk, got)
+					}
+				}
+			}
+
+			entry := proc.entryPoint
+			if after := live.liveAfter(entry); after[1].has(3) {
+				t.Fatalf("t should be dead")
+			} else if !after[1].has(2) {
+				t.Fatalf("r should be live")
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiveness_PruneParams(t *testing.T) {
+	expected := `func pow(b u64, e u64) u64 {
+ var r u64
+ var t u64
+ entry(b.0, e.0):
+  jmp loop(b.0, e.0, 0x1, 0x5)
+ loop(b.1, e.1, r.1, t.1):
+  jnz e.1, body(b.1, e.1, r.1, t.1), done(r.1)
+ body(b.2, e.2, r.2, t.2):
+  mul r.3, r.2, b.2
+  sub e.3, e.2, 0x1
+  jmp loop(b.2, e.3, r.3, t.2)
+ done(r.4):
+  ret r.4
+}
+`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   livenessSource,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			proc, _ = reallycrudessa(proc)
+			proc = Pass_CopyPropagation(proc)
+			proc = Pass_PruneParams(proc)
+			var sb strings.Builder
+			printproc(&sb, proc)
+			if s := sb.String(); s != expected {
+				t.Fatal(s)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
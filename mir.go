@@ -0,0 +1,153 @@
+package cube
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// a machineOpcode is an instruction of a target. format is its assembler
+// text in which $d stands for the destination register, $0 to $2 for the
+// source registers, $i for the immediate in decimal and $x in hex.
+// latency is the number of cycles until its result can be used, where 0
+// means 1.
+type machineOpcode struct {
+	name    string
+	format  string
+	latency int
+}
+
+var (
+	// copies its source, a register or a constant, to its destination
+	machine_MOV = &machineOpcode{name: "mov"}
+	// the call of the ir instruction, which the target lowers itself
+	machine_CALL = &machineOpcode{name: "call"}
+	// the ir instruction, which the target lowers itself
+	machine_IR = &machineOpcode{name: "ir"}
+)
+
+// returns the assembler text of the opcode for the given registers
+func (this *machineOpcode) text(dst string, srcs []string, imm int64) string {
+	pairs := []string{
+		"$d", dst,
+		"$i", strconv.FormatInt(imm, 10),
+		"$x", fmt.Sprintf("0x%x", uint64(imm)),
+	}
+	for i, src := range srcs {
+		pairs = append(pairs, fmt.Sprintf("$%d", i), src)
+	}
+	return strings.NewReplacer(pairs...).Replace(this.format)
+}
+
+// a machineInstr is an instruction of a target. its operands are virtual
+// registers, which are the ssa registers of the procedure followed by
+// the temporaries created by instruction selection. only copies and calls
+// take constants.
+type machineInstr struct {
+	opcode *machineOpcode
+	dst    operand
+	srcs   []operand
+	imm    int64
+	// the ir instruction of a call or of machine_IR
+	ir *Instruction
+}
+
+// machineBlock holds the machine instructions of a block. the terminator
+// stays in the ir.
+type machineBlock struct {
+	block  *BasicBlock
+	instrs []*machineInstr
+}
+
+// a machineProc holds the machine instructions of the reachable blocks of
+// a procedure in the order of code generation
+type machineProc struct {
+	proc   *Procedure
+	blocks []*machineBlock
+	nvregs int
+}
+
+// returns a new virtual register
+func (this *machineProc) newTemp() operand {
+	this.nvregs += 1
+	return operandReg(this.nvregs - 1)
+}
+
+// returns the name of a virtual register. temporaries are numbered
+// without a dot so they never look like an ssa register.
+func (this *machineProc) regName(op operand) string {
+	if otype, val := op.unpack(); otype == operandType_CON {
+		return fmt.Sprintf("0x%x", this.proc.constants[val])
+	} else if val < len(this.proc.ssaregs) {
+		return this.proc.ssaregs[val].String()
+	} else {
+		return fmt.Sprintf("t%d", val-len(this.proc.ssaregs))
+	}
+}
+
+// lowerIR makes a machine instruction for every ir instruction that
+// refers back to it, for targets that lower the ir by hand. the bytecode
+// has an instruction for every ir instruction and any number of slots,
+// so it has nothing to select or schedule. movs become copies so that the
+// allocator can coalesce them.
+func lowerIR(proc *Procedure, order []*BasicBlock) *machineProc {
+	mp := &machineProc{
+		proc:   proc,
+		nvregs: len(proc.ssaregs),
+	}
+
+	for _, blk := range order {
+		mb := &machineBlock{block: blk}
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			mi := &machineInstr{opcode: machine_IR, dst: insr.operands[0], ir: insr}
+			if insr.opcode == opcode_CALL {
+				mi.opcode = machine_CALL
+			} else if insr.opcode == opcode_MOV {
+				mi.opcode = machine_MOV
+			}
+			insr.visitUses(func(op *operand) {
+				mi.srcs = append(mi.srcs, *op)
+			})
+			mb.instrs = append(mb.instrs, mi)
+		}
+		mp.blocks = append(mp.blocks, mb)
+	}
+	return mp
+}
+
+func printMachineInstr(w io.Writer, mp *machineProc, mi *machineInstr) {
+	var srcs []string
+	for _, src := range mi.srcs {
+		srcs = append(srcs, mp.regName(src))
+	}
+
+	switch mi.opcode {
+	case machine_MOV:
+		fmt.Fprintf(w, "mov %s, %s", mp.regName(mi.dst), srcs[0])
+	case machine_CALL:
+		fmt.Fprintf(w, "call %s, %s(%s)", mp.regName(mi.dst), mi.ir.callee, strings.Join(srcs, ", "))
+	case machine_IR:
+		printInstruction(w, mp.proc, mi.ir)
+	default:
+		fmt.Fprint(w, mi.opcode.text(mp.regName(mi.dst), srcs, mi.imm))
+	}
+}
+
+// printMachineProc writes the machine instructions of every block
+// followed by its terminator in the ir
+func printMachineProc(w io.Writer, mp *machineProc) {
+	for _, mb := range mp.blocks {
+		printBlockHeader(w, mp.proc, mb.block)
+		fmt.Fprintf(w, "\n")
+		for _, mi := range mb.instrs {
+			fmt.Fprintf(w, "\t")
+			printMachineInstr(w, mp, mi)
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "\t")
+		printTerminator(w, mp.proc, mb.block)
+		fmt.Fprintf(w, "\n")
+	}
+}
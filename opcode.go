@@ -9,13 +9,15 @@ func (this *opcode) String() string {
 }
 
 var (
-	opcode_ADD = &opcode{"add"}
-	opcode_JMP = &opcode{"jmp"}
-	opcode_JNZ = &opcode{"jnz"}
-	opcode_MOV = &opcode{"mov"}
-	opcode_MUL = &opcode{"mul"}
-	opcode_RET = &opcode{"ret"}
-	opcode_SUB = &opcode{"sub"}
+	opcode_ADD  = &opcode{"add"}
+	opcode_CALL = &opcode{"call"}
+	opcode_JMP  = &opcode{"jmp"}
+	opcode_JNZ  = &opcode{"jnz"}
+	opcode_MOV  = &opcode{"mov"}
+	opcode_MUL  = &opcode{"mul"}
+	opcode_RET  = &opcode{"ret"}
+	opcode_SHL  = &opcode{"shl"}
+	opcode_SUB  = &opcode{"sub"}
 )
 
 type operandType int
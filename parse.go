@@ -1,8 +1,8 @@
 package cube
 
 import (
-	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -12,27 +12,43 @@ type unresolvedLabel struct {
 	succidx int
 }
 
+type unresolvedCall struct {
+	callee string
+	nargs  int
+	span   span
+}
+
 type parseContext struct {
 	config *Config
 	lexer  *Lexer
 	peek   Token
 
+	module           Module
 	localdefs        map[string]int
 	blockdefs        map[string]*BasicBlock
-	curproc          Procedure
+	curproc          *Procedure
 	curblock         *BasicBlock
+	curspan          span
+	prevEnd          int
+	prevLineNo       int
+	ssa              bool
+	regdefs          map[ssaRegKey]int
 	unresolvedLabels map[string][]unresolvedLabel
+	unresolvedCalls  []unresolvedCall
+	pendingLabel     Token
+	diagnostics      Diagnostics
 }
 
-func (this *parseContext) registerLocal(name string, dtype *Type, param bool) error {
+func (this *parseContext) registerLocal(name string, sp span, dtype *Type, param bool) error {
 	if _, exists := this.localdefs[name]; exists {
-		return this.error(fmt.Sprintf("local %s is redefined here", name))
+		return this.errorAt(sp, diag_REDEFINED, fmt.Sprintf("local %s is redefined here", name))
 	} else {
 		index := len(this.localdefs)
 		newlocal := Local{
 			name:        name,
 			dataType:    dtype,
 			isParameter: param,
+			span:        sp,
 		}
 
 		this.curproc.locals = append(this.curproc.locals, newlocal)
@@ -43,29 +59,60 @@ func (this *parseContext) registerLocal(name string, dtype *Type, param bool) er
 
 func (this *parseContext) lookupLocal(name string) (int, error) {
 	if local, ok := this.localdefs[name]; !ok {
-		return 0, this.error(fmt.Sprintf("undefined local '%s' referenced here", name))
+		return 0, this.error(diag_UNDEFINED, fmt.Sprintf("undefined local '%s' referenced here", name))
 	} else {
 		return local, nil
 	}
 }
 
-func (this *parseContext) error(errmsg string) error {
-	return errors.New(fmt.Sprintf("%s:%d: %s", this.config.Filename, this.peek.LineNo, errmsg))
+func (this *parseContext) error(code, errmsg string) error {
+	return this.errorAt(tokenSpan(this.peek), code, errmsg)
+}
+
+func (this *parseContext) errorAt(sp span, code, errmsg string) error {
+	return &Diagnostic{
+		Severity: SeverityError,
+		Filename: this.config.Filename,
+		Line:     sp.lineno,
+		Column:   sp.column,
+		Offset:   sp.offset,
+		Length:   sp.length,
+		Code:     code,
+		Message:  errmsg,
+	}
+}
+
+// records a diagnostic and reports whether parsing can continue
+func (this *parseContext) diagnose(err error) bool {
+	if diag, ok := err.(*Diagnostic); !ok {
+		return false
+	} else {
+		this.diagnostics = append(this.diagnostics, diag)
+		if this.config.Diagnostic != nil {
+			this.config.Diagnostic(diag)
+		}
+		if diag.Severity == SeverityWarning && this.config.Warning != nil {
+			this.config.Warning(diag.Error())
+		}
+		return true
+	}
 }
 
 func (this *parseContext) unexpected() error {
 	if this.peek.Type == EOF {
-		return this.error("unexpected end of file")
+		return this.error(diag_SYNTAX, "unexpected end of file")
 	} else {
-		return this.error(fmt.Sprintf("unexpected symbol '%s'", this.peek.Value))
+		return this.error(diag_SYNTAX, fmt.Sprintf("unexpected symbol '%s'", this.peek.Value))
 	}
 }
 
 func (this *parseContext) advance() error {
+	this.prevEnd = this.peek.Offset + len(this.peek.Value)
+	this.prevLineNo = this.peek.LineNo
 	this.peek = this.lexer.Scan()
 
 	if this.peek.Type == ILLEGAL {
-		return this.error(fmt.Sprintf("illegal character '%s'", this.peek.Value))
+		return this.error(diag_ILLEGAL, fmt.Sprintf("illegal character '%s'", this.peek.Value))
 	}
 
 	return nil
@@ -105,6 +152,18 @@ func (this *parseContext) typename() (*Type, error) {
 	}
 }
 
+// parses the optional calling convention that follows the return type
+func (this *parseContext) callingConv() error {
+	if this.peek.Type != IDENT {
+		return nil
+	} else if name := this.peek.Value; !isCallingConv(name) {
+		return this.error(diag_CALLCONV, fmt.Sprintf("unknown calling convention %s", name))
+	} else {
+		this.curproc.callconv = name
+		return this.advance()
+	}
+}
+
 func (this *parseContext) parameters() error {
 	if matched, err := this.match(PAREN_R); err != nil {
 		return err
@@ -112,11 +171,11 @@ func (this *parseContext) parameters() error {
 		return nil
 	} else {
 		for {
-			if name, err := this.ident(); err != nil {
+			if token, err := this.expect(IDENT); err != nil {
 				return err
 			} else if dtype, err := this.typename(); err != nil {
 				return err
-			} else if err := this.registerLocal(name, dtype, true); err != nil {
+			} else if err := this.registerLocal(token.Value, tokenSpan(token), dtype, true); err != nil {
 				return err
 			} else {
 				switch this.peek.Type {
@@ -143,11 +202,11 @@ func (this *parseContext) vars() error {
 		} else if !matched {
 			return nil
 		} else {
-			if name, err := this.ident(); err != nil {
+			if token, err := this.expect(IDENT); err != nil {
 				return err
 			} else if dtype, err := this.typename(); err != nil {
 				return err
-			} else if err := this.registerLocal(name, dtype, false); err != nil {
+			} else if err := this.registerLocal(token.Value, tokenSpan(token), dtype, false); err != nil {
 				return err
 			}
 		}
@@ -160,25 +219,15 @@ func parseInt(val string) (uint64, error) {
 		base = 2
 	}
 
-	if num, err := strconv.ParseInt(val, base, 64); err != nil {
+	if len(val) > 0 && val[0] != '-' {
+		return strconv.ParseUint(val, base, 64)
+	} else if num, err := strconv.ParseInt(val, base, 64); err != nil {
 		return 0, err
 	} else {
 		return uint64(num), nil
 	}
 }
 
-func (this *parseContext) constant(num uint64) int {
-	for i, c := range this.curproc.constants {
-		if c == num {
-			return i
-		}
-	}
-
-	i := len(this.curproc.constants)
-	this.curproc.constants = append(this.curproc.constants, num)
-	return i
-}
-
 func (this *parseContext) local() (int, error) {
 	if ident, err := this.ident(); err != nil {
 		return 0, err
@@ -189,16 +238,29 @@ func (this *parseContext) local() (int, error) {
 	}
 }
 
+// parses the destination of an instruction, a local or in ssa form a register
+func (this *parseContext) destination() (operand, error) {
+	if this.ssa {
+		return this.register()
+	} else if local, err := this.local(); err != nil {
+		return operandNil, err
+	} else {
+		return operandLoc(local), nil
+	}
+}
+
 func (this *parseContext) atom() (operand, error) {
 	switch this.peek.Type {
 	case INTEGER:
 		if num, err := parseInt(this.peek.Value); err != nil {
-			return operandNil, this.error(err.Error())
+			return operandNil, this.error(diag_INTEGER, err.Error())
 		} else {
-			return operandCon(this.constant(num)), this.advance()
+			return operandCon(this.curproc.constant(num)), this.advance()
 		}
 	case IDENT:
-		if local, err := this.lookupLocal(this.peek.Value); err != nil {
+		if this.ssa {
+			return this.register()
+		} else if local, err := this.lookupLocal(this.peek.Value); err != nil {
 			return operandNil, err
 		} else {
 			return operandLoc(local), this.advance()
@@ -208,9 +270,12 @@ func (this *parseContext) atom() (operand, error) {
 	}
 }
 
+// parses a jump target and in ssa form also its arguments
 func (this *parseContext) label(succidx int) (*BasicBlock, error) {
 	if name, err := this.ident(); err != nil {
 		return nil, err
+	} else if err := this.jumpArguments(succidx); err != nil {
+		return nil, err
 	} else if block, ok := this.blockdefs[name]; !ok {
 		unresolved, _ := this.unresolvedLabels[name]
 		this.unresolvedLabels[name] = append(unresolved, unresolvedLabel{
@@ -231,10 +296,17 @@ func (this *parseContext) resolveLabel(name string, block *BasicBlock) {
 	delete(this.unresolvedLabels, name)
 }
 
+// returns the span from the start of the current instruction
+// to the end of the last token consumed
+func (this *parseContext) instructionSpan() span {
+	return this.curspan.to(this.prevEnd)
+}
+
 func (this *parseContext) emit(opc *opcode, op0, op1, op2 operand) error {
 	this.curblock.instructions = append(this.curblock.instructions, Instruction{
 		opcode:   opc,
 		operands: [3]operand{op0, op1, op2},
+		span:     this.instructionSpan(),
 	})
 	return nil
 }
@@ -244,6 +316,7 @@ func (this *parseContext) ret() error {
 		return err
 	} else {
 		this.curblock.jmpcode = opcode_RET
+		this.curblock.jmpspan = this.instructionSpan()
 		this.curblock.jmpretval = op1
 		return nil
 	}
@@ -254,13 +327,24 @@ func (this *parseContext) jmp() error {
 		return err
 	} else {
 		this.curblock.jmpcode = opcode_JMP
+		this.curblock.jmpspan = this.instructionSpan()
 		this.curblock.successors[0] = op0
 		return nil
 	}
 }
 
+// parses the condition of jnz, a local or in ssa form any operand
+// because passes may replace the register with a constant
+func (this *parseContext) condition() (operand, error) {
+	if this.ssa {
+		return this.atom()
+	} else {
+		return this.destination()
+	}
+}
+
 func (this *parseContext) jnz() error {
-	if op0, err := this.local(); err != nil {
+	if op0, err := this.condition(); err != nil {
 		return err
 	} else if _, err := this.expect(COMMA); err != nil {
 		return err
@@ -272,7 +356,8 @@ func (this *parseContext) jnz() error {
 		return err
 	} else {
 		this.curblock.jmpcode = opcode_JNZ
-		this.curblock.jmpretval = operandLoc(op0)
+		this.curblock.jmpspan = this.instructionSpan()
+		this.curblock.jmpretval = op0
 		this.curblock.successors[0] = op1
 		this.curblock.successors[1] = op2
 		return nil
@@ -280,7 +365,7 @@ func (this *parseContext) jnz() error {
 }
 
 func (this *parseContext) instruction_raa(opc *opcode) error {
-	if dstloc, err := this.local(); err != nil {
+	if dst, err := this.destination(); err != nil {
 		return err
 	} else if _, err := this.expect(COMMA); err != nil {
 		return err
@@ -291,26 +376,92 @@ func (this *parseContext) instruction_raa(opc *opcode) error {
 	} else if op2, err := this.atom(); err != nil {
 		return err
 	} else {
-		return this.emit(opc, operandLoc(dstloc), op1, op2)
+		return this.emit(opc, dst, op1, op2)
 	}
 }
 
 func (this *parseContext) instruction_ra(opc *opcode) error {
-	if dstloc, err := this.local(); err != nil {
+	if dst, err := this.destination(); err != nil {
 		return err
 	} else if _, err := this.expect(COMMA); err != nil {
 		return err
 	} else if op1, err := this.atom(); err != nil {
 		return err
 	} else {
-		return this.emit(opc, operandLoc(dstloc), op1, operandNil)
+		return this.emit(opc, dst, op1, operandNil)
+	}
+}
+
+func (this *parseContext) arguments() ([]operand, error) {
+	var args []operand
+	if matched, err := this.match(PAREN_R); err != nil {
+		return nil, err
+	} else if matched {
+		return args, nil
+	} else {
+		for {
+			if arg, err := this.atom(); err != nil {
+				return nil, err
+			} else {
+				args = append(args, arg)
+				switch this.peek.Type {
+				case COMMA:
+					if err := this.advance(); err != nil {
+						return nil, err
+					} else {
+						continue
+					}
+				case PAREN_R:
+					return args, this.advance()
+				default:
+					return nil, this.unexpected()
+				}
+			}
+		}
+	}
+}
+
+func (this *parseContext) call() error {
+	if dst, err := this.destination(); err != nil {
+		return err
+	} else if _, err := this.expect(COMMA); err != nil {
+		return err
+	} else if callee, err := this.ident(); err != nil {
+		return err
+	} else if _, err := this.expect(PAREN_L); err != nil {
+		return err
+	} else if args, err := this.arguments(); err != nil {
+		return err
+	} else {
+		this.unresolvedCalls = append(this.unresolvedCalls, unresolvedCall{
+			callee: callee,
+			nargs:  len(args),
+			span:   this.instructionSpan(),
+		})
+		this.curblock.instructions = append(this.curblock.instructions, Instruction{
+			opcode:    opcode_CALL,
+			operands:  [3]operand{dst, operandNil, operandNil},
+			callee:    callee,
+			arguments: args,
+			span:      this.instructionSpan(),
+		})
+		return nil
 	}
 }
 
+func (this *parseContext) missingTerminator() error {
+	errmsg := fmt.Sprintf("block %s does not end with ret, jmp or jnz", this.curblock)
+	return this.errorAt(this.curspan, diag_TERMINATOR, errmsg)
+}
+
 func (this *parseContext) instructions() error {
 	for {
 		tokenType := this.peek.Type
-		if err := this.advance(); err != nil {
+		token := this.peek
+		this.curspan = tokenSpan(this.peek)
+		if tokenType == CURLY_R || tokenType == EOF {
+			return this.missingTerminator()
+		} else if err := this.advance(); err != nil {
 			return err
 		} else {
 			var err error
@@ -321,14 +472,24 @@ func (this *parseContext) instructions() error {
 				err = this.instruction_raa(opcode_SUB)
 			case MUL:
 				err = this.instruction_raa(opcode_MUL)
+			case SHL:
+				err = this.instruction_raa(opcode_SHL)
 			case MOV:
 				err = this.instruction_ra(opcode_MOV)
+			case CALL:
+				err = this.call()
 			case RET:
 				return this.ret()
 			case JMP:
 				return this.jmp()
 			case JNZ:
 				return this.jnz()
+			case IDENT:
+				if this.atLabel() {
+					this.pendingLabel = token
+					return this.missingTerminator()
+				}
+				return this.unexpected()
 			default:
 				return this.unexpected()
 			}
@@ -340,48 +501,154 @@ func (this *parseContext) instructions() error {
 	}
 }
 
+// reports whether the identifier before peek is a label, which is
+// followed by a colon or in ssa form by its parameters
+func (this *parseContext) atLabel() bool {
+	return this.peek.Type == COLON || (this.ssa && this.peek.Type == PAREN_L)
+}
+
+// skips to the next label and returns it or false if the end
+// of the procedure was reached first
+func (this *parseContext) skipToLabel() (Token, bool) {
+	if label := this.pendingLabel; label.Type == IDENT {
+		this.pendingLabel = Token{}
+		return label, true
+	}
+
+	for {
+		switch this.peek.Type {
+		case CURLY_R, EOF, FUNC:
+			return Token{}, false
+		case IDENT:
+			// labels start a line, which tells them apart from
+			// jump targets with arguments in ssa form
+			label := this.peek
+			startsLine := this.prevLineNo != label.LineNo
+			this.advance()
+			if startsLine && this.atLabel() {
+				return label, true
+			}
+		default:
+			this.advance()
+		}
+	}
+}
+
+func (this *parseContext) block(label Token) error {
+	name := label.Value
+	this.curblock = &BasicBlock{
+		name: name,
+		span: tokenSpan(label),
+	}
+
+	if _, exists := this.blockdefs[name]; exists {
+		this.diagnose(this.errorAt(this.curblock.span, diag_REDEFINED, fmt.Sprintf("block %s redefined here", name)))
+	} else {
+		this.blockdefs[name] = this.curblock
+		this.resolveLabel(name, this.curblock)
+	}
+
+	this.curproc.blocks = append(this.curproc.blocks, this.curblock)
+
+	if err := this.blockParameters(); err != nil {
+		return err
+	} else if _, err := this.expect(COLON); err != nil {
+		return err
+	} else {
+		return this.instructions()
+	}
+}
+
 func (this *parseContext) blocks() error {
 	this.blockdefs = map[string]*BasicBlock{}
 	this.unresolvedLabels = map[string][]unresolvedLabel{}
 
 	for do := true; do; do = this.peek.Type != CURLY_R {
-		if name, err := this.ident(); err != nil {
-			return err
-		} else if _, err := this.expect(COLON); err != nil {
+		if label, err := this.expect(IDENT); err != nil {
 			return err
-		} else if _, exists := this.blockdefs[name]; exists {
-			return this.error(fmt.Sprintf("block %s redefined here", name))
 		} else {
-			this.curblock = &BasicBlock{
-				name: name,
+			for err := this.block(label); err != nil; err = this.block(label) {
+				var ok bool
+				if !this.diagnose(err) {
+					return err
+				} else if label, ok = this.skipToLabel(); !ok {
+					return nil
+				}
 			}
-			this.blockdefs[name] = this.curblock
+		}
+	}
 
-			this.resolveLabel(name, this.curblock)
+	return nil
+}
 
-			if err := this.instructions(); err != nil {
-				return err
-			} else {
-				this.curproc.blocks = append(this.curproc.blocks, this.curblock)
-			}
+// reports a diagnostic as an error or a warning depending on level
+func (this *parseContext) report(level CheckLevel, sp span, code, errmsg string) {
+	if level != CheckIgnore {
+		diag := this.errorAt(sp, code, errmsg).(*Diagnostic)
+		if level == CheckWarn {
+			diag.Severity = SeverityWarning
 		}
+		this.diagnose(diag)
 	}
+}
 
-	return nil
+func (this *parseContext) checkUninitialized() {
+	for _, use := range uninitializedUses(this.curproc) {
+		local := this.curproc.locals[use.local].name
+		errmsg := fmt.Sprintf("local %s may be used before it is assigned", local)
+		this.report(this.config.Uninitialized, use.span, diag_UNINITIALIZED, errmsg)
+	}
+}
+
+func (this *parseContext) checkReturns() {
+	proc := this.curproc
+	for _, blk := range proc.blocks {
+		if blk.jmpcode != opcode_RET {
+			continue
+		} else if dtype := proc.operandType(blk.jmpretval); dtype != nil && dtype != proc.returnType {
+			errmsg := fmt.Sprintf("ret of %s which has type %s in procedure returning %s",
+				operandString(proc, blk.jmpretval), dtype, proc.returnType)
+			this.diagnose(this.errorAt(blk.jmpspan, diag_RETURNTYPE, errmsg))
+		}
+	}
+
+	if trapped := nonReturningBlocks(proc); len(trapped) > 0 && trapped[0] == proc.entryPoint {
+		errmsg := fmt.Sprintf("procedure %s never returns", proc.name)
+		this.report(this.config.InfiniteLoops, proc.entryPoint.jmpspan, diag_NORETURN, errmsg)
+	} else {
+		for _, blk := range trapped {
+			errmsg := fmt.Sprintf("block %s enters a loop that never returns", blk)
+			this.report(this.config.InfiniteLoops, blk.jmpspan, diag_NORETURN, errmsg)
+		}
+	}
 }
 
 func (this *parseContext) procedure() error {
-	this.curproc = Procedure{}
+	this.curproc = &Procedure{}
 	this.localdefs = map[string]int{}
+	this.regdefs = map[ssaRegKey]int{}
+	errors := this.diagnostics.errors()
 
-	if name, err := this.ident(); err != nil {
+	name, err := this.ident()
+	if err != nil {
 		return err
-	} else if _, err := this.expect(PAREN_L); err != nil {
+	} else if this.module.lookup(name) != nil {
+		return this.error(diag_REDEFINED, fmt.Sprintf("procedure %s redefined here", name))
+	}
+
+	// register the procedure before parsing its body so that calls
+	// to it still resolve if the body has errors
+	this.curproc.name = name
+	this.module.procedures = append(this.module.procedures, this.curproc)
+
+	if _, err := this.expect(PAREN_L); err != nil {
 		return err
 	} else if err := this.parameters(); err != nil {
 		return err
 	} else if rtype, err := this.typename(); err != nil {
 		return err
+	} else if err := this.callingConv(); err != nil {
+		return err
 	} else if _, err := this.expect(CURLY_L); err != nil {
 		return err
 	} else if err := this.vars(); err != nil {
@@ -395,17 +662,55 @@ func (this *parseContext) procedure() error {
 		for k, _ := range this.unresolvedLabels {
 			labels = append(labels, k)
 		}
+		sort.Strings(labels)
 		if len(labels) > 1 {
 			joinedLabels := strings.Join(labels, ", ")
-			return this.error(fmt.Sprintf("unresolved references to labels %s", joinedLabels))
+			return this.error(diag_UNDEFINED, fmt.Sprintf("unresolved references to labels %s", joinedLabels))
 		} else {
-			return this.error(fmt.Sprintf("unresolved reference to label %s", labels[0]))
+			return this.error(diag_UNDEFINED, fmt.Sprintf("unresolved reference to label %s", labels[0]))
 		}
+	} else if this.diagnostics.errors() > errors {
+		return nil
 	} else {
-		this.curproc.name = name
 		this.curproc.returnType = rtype
 		this.curproc.entryPoint = this.curproc.blocks[0]
-		return this.config.Procedure(&this.curproc)
+		if this.checkReturns(); this.ssa {
+			predecessors(this.curproc.blocks)
+		} else if this.config.Uninitialized != CheckIgnore {
+			this.checkUninitialized()
+		}
+		if this.diagnostics.errors() == 0 && this.config.Procedure != nil {
+			return this.config.Procedure(this.curproc)
+		}
+		return nil
+	}
+}
+
+func (this *parseContext) resolveCalls() error {
+	for _, call := range this.unresolvedCalls {
+		if callee := this.module.lookup(call.callee); callee == nil {
+			errmsg := fmt.Sprintf("call to undefined procedure %s", call.callee)
+			this.diagnose(this.errorAt(call.span, diag_UNDEFINED, errmsg))
+		} else if nparams := callee.numParameters(); nparams != call.nargs {
+			errmsg := fmt.Sprintf("procedure %s takes %d arguments but %d were given", call.callee, nparams, call.nargs)
+			this.diagnose(this.errorAt(call.span, diag_ARGUMENTS, errmsg))
+		}
+	}
+
+	this.unresolvedCalls = nil
+
+	if this.diagnostics.errors() > 0 {
+		return this.diagnostics
+	} else if this.config.Module != nil {
+		return this.config.Module(&this.module)
+	}
+	return nil
+}
+
+// skips to the next procedure after an error
+func (this *parseContext) skipToProcedure() {
+	for this.peek.Type != FUNC && this.peek.Type != EOF {
+		this.advance()
 	}
 }
 
@@ -413,23 +718,27 @@ func (this *parseContext) definitions() error {
 	for {
 		switch this.peek.Type {
 		case FUNC:
-			if err := this.advance(); err != nil {
+			if err := this.advance(); err != nil && !this.diagnose(err) {
 				return err
 			} else if err := this.procedure(); err != nil {
-				return err
+				if !this.diagnose(err) {
+					return err
+				}
+				this.skipToProcedure()
 			}
 		case EOF:
-			return nil
+			return this.resolveCalls()
 		default:
-			return this.unexpected()
+			this.diagnose(this.unexpected())
+			this.skipToProcedure()
 		}
 	}
 }
 
 func (this *parseContext) parse() error {
 	if err := this.advance(); err != nil {
-		return err
-	} else {
-		return this.definitions()
+		this.diagnose(err)
+		this.skipToProcedure()
 	}
+	return this.definitions()
 }
@@ -56,3 +56,204 @@ func TestParse_2(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParse_MissingTerminator(t *testing.T) {
+	sources := []string{`
+	func f(a u64) u64 {
+		entry:
+			add a, a, 1
+		next:
+			ret a
+	}`, `
+	func f(a u64) u64 {
+		entry:
+			add a, a, 1
+	}`,
+	}
+
+	expected := "test.cubeasm:5: block entry does not end with ret, jmp or jnz"
+	for _, source := range sources {
+		err := Compile(&Config{
+			Filename: "test.cubeasm",
+			Source:   source,
+		})
+
+		if err == nil || err.Error() != expected {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParse_InfiniteLoops(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		entry:
+			jnz a, loop, done
+		loop:
+			jmp loop
+		done:
+			ret a
+	}`
+
+	var warnings []string
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        source,
+		InfiniteLoops: CheckWarn,
+		Warning: func(msg string) {
+			warnings = append(warnings, msg)
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if len(warnings) != 1 || warnings[0] != "test.cubeasm:6: warning: block loop enters a loop that never returns" {
+		t.Fatal(warnings)
+	}
+
+	err = Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        `func f() u64 { entry: jmp entry }`,
+		InfiniteLoops: CheckError,
+	})
+
+	if err == nil || err.Error() != "test.cubeasm:1: procedure f never returns" {
+		t.Fatal(err)
+	}
+}
+
+func TestParse_ReturnType(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		var b u64
+		entry:
+			mov b, a
+			jnz a, yes, no
+		yes:
+			ret b
+		no:
+			ret 0
+	}`
+
+	var proc *Procedure
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(p *Procedure) error {
+			proc = p
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// u64 is the only type the parser knows, so give b another one
+	proc.locals[1].dataType = &Type{"u32"}
+	ctx := &parseContext{
+		config:  &Config{Filename: "test.cubeasm"},
+		curproc: proc,
+	}
+
+	ctx.checkReturns()
+	if len(ctx.diagnostics) != 1 {
+		t.Fatal(ctx.diagnostics)
+	} else if diag := ctx.diagnostics[0]; diag.Code != diag_RETURNTYPE || diag.Line != 8 {
+		t.Fatal(diag)
+	} else if diag.Message != "ret of b which has type u32 in procedure returning u64" {
+		t.Fatal(diag.Message)
+	}
+}
+
+func TestParse_Diagnostics(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		entry:
+			add a, b, 1
+			jmp next
+		next:
+			ret a
+		next:
+			ret c
+	}
+
+	func g() u64 {
+		entry:
+			call r, h()
+			ret r
+	}
+
+	func f() u64 {
+		entry:
+			ret 0
+	}`
+
+	var codes []string
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Diagnostic: func(diag *Diagnostic) {
+			codes = append(codes, diag.Code)
+		},
+	})
+
+	expected := []string{
+		"test.cubeasm:4: undefined local 'b' referenced here",
+		"test.cubeasm:8: block next redefined here",
+		"test.cubeasm:9: undefined local 'c' referenced here",
+		"test.cubeasm:14: undefined local 'r' referenced here",
+		"test.cubeasm:18: procedure f redefined here",
+	}
+
+	if diags, ok := err.(Diagnostics); !ok {
+		t.Fatal(err)
+	} else if len(diags) != len(expected) || len(codes) != len(expected) {
+		t.Fatal(err)
+	} else {
+		for i, diag := range diags {
+			if diag.Error() != expected[i] || diag.Code != codes[i] {
+				t.Fatal(diag)
+			}
+		}
+	}
+}
+
+func TestParse_Spans(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		var b u64
+		entry:
+			add b, a,  1
+			jnz b, entry, exit
+		exit:
+			ret b
+	}`
+
+	err := Compile(&Config{
+		Source: source,
+		Procedure: func(proc *Procedure) error {
+			text := func(sp span) string {
+				return source[sp.offset : sp.offset+sp.length]
+			}
+
+			entry := proc.blocks[0]
+			if text(entry.span) != "entry" || entry.span.String() != "4:3" {
+				t.Fatal(entry.span)
+			} else if text(entry.instructions[0].span) != "add b, a,  1" {
+				t.Fatal(entry.instructions[0].span)
+			} else if text(entry.jmpspan) != "jnz b, entry, exit" || entry.jmpspan.String() != "6:4" {
+				t.Fatal(entry.jmpspan)
+			} else if text(proc.blocks[1].jmpspan) != "ret b" {
+				t.Fatal(proc.blocks[1].jmpspan)
+			} else if text(proc.locals[0].span) != "a" || text(proc.locals[1].span) != "b" {
+				t.Fatal(proc.locals)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,371 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// a Pass transforms a procedure. passes that keep the cfg intact
+// should list the analyses they preserve so they are not recomputed.
+type Pass interface {
+	Name() string
+	Preserves() []string
+	Run(pm *PassManager, proc *Procedure) (*Procedure, error)
+}
+
+// an Analysis computes a result from a procedure that is cached by
+// the PassManager until a pass invalidates it.
+type Analysis interface {
+	Name() string
+	Compute(pm *PassManager, proc *Procedure) interface{}
+}
+
+type passFunc struct {
+	name      string
+	preserves []string
+	run       func(pm *PassManager, proc *Procedure) (*Procedure, error)
+}
+
+func (this *passFunc) Name() string {
+	return this.name
+}
+
+func (this *passFunc) Preserves() []string {
+	return this.preserves
+}
+
+func (this *passFunc) Run(pm *PassManager, proc *Procedure) (*Procedure, error) {
+	return this.run(pm, proc)
+}
+
+type analysisFunc struct {
+	name    string
+	compute func(pm *PassManager, proc *Procedure) interface{}
+}
+
+func (this *analysisFunc) Name() string {
+	return this.name
+}
+
+func (this *analysisFunc) Compute(pm *PassManager, proc *Procedure) interface{} {
+	return this.compute(pm, proc)
+}
+
+type PassTiming struct {
+	Pass      string
+	Procedure string
+	Duration  time.Duration
+}
+
+type PassManager struct {
+	// Module is searched for callees by the inline pass
+	Module *Module
+	// Verify checks the ir after every pass
+	Verify bool
+	// Dump receives the ir after every pass named in DumpAfter,
+	// or after every pass if DumpAfter is empty
+	Dump      io.Writer
+	DumpAfter []string
+	// Timings records how long each pass took
+	Timings []PassTiming
+
+	// tuning parameters of the inline and unroll passes
+	InlineSize   int
+	UnrollFactor int
+	UnrollSize   int
+
+	passes    map[string]Pass
+	analyses  map[string]Analysis
+	pipelines map[string][]string
+	cache     map[*Procedure]map[string]interface{}
+}
+
+func NewPassManager() *PassManager {
+	pm := &PassManager{
+		InlineSize:   16,
+		UnrollFactor: 2,
+		UnrollSize:   64,
+		passes:       map[string]Pass{},
+		analyses:     map[string]Analysis{},
+		pipelines:    map[string][]string{},
+		cache:        map[*Procedure]map[string]interface{}{},
+	}
+
+	for _, pass := range builtinPasses {
+		pm.RegisterPass(pass)
+	}
+
+	for _, analysis := range builtinAnalyses {
+		pm.RegisterAnalysis(analysis)
+	}
+
+	for name, passes := range builtinPipelines {
+		pm.RegisterPipeline(name, passes)
+	}
+
+	return pm
+}
+
+func (this *PassManager) RegisterPass(pass Pass) {
+	this.passes[pass.Name()] = pass
+}
+
+func (this *PassManager) RegisterAnalysis(analysis Analysis) {
+	this.analyses[analysis.Name()] = analysis
+}
+
+func (this *PassManager) RegisterPipeline(name string, passes []string) {
+	this.pipelines[name] = passes
+}
+
+func (this *PassManager) Pipelines() []string {
+	var names []string
+	for name, _ := range this.pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Analysis returns the cached result of the named analysis,
+// computing it first if necessary
+func (this *PassManager) Analysis(proc *Procedure, name string) interface{} {
+	cache, ok := this.cache[proc]
+	if !ok {
+		cache = map[string]interface{}{}
+		this.cache[proc] = cache
+	}
+
+	if result, ok := cache[name]; ok {
+		return result
+	} else if analysis, ok := this.analyses[name]; !ok {
+		panic("unknown analysis " + name)
+	} else {
+		result := analysis.Compute(this, proc)
+		cache[name] = result
+		return result
+	}
+}
+
+func (this *PassManager) invalidate(proc *Procedure, preserved []string) {
+	if cache, ok := this.cache[proc]; ok {
+		for name, _ := range cache {
+			keep := false
+			for _, p := range preserved {
+				keep = keep || p == name
+			}
+			if !keep {
+				delete(cache, name)
+			}
+		}
+	}
+}
+
+func (this *PassManager) dumpAfter(name string) bool {
+	if this.Dump == nil {
+		return false
+	} else if len(this.DumpAfter) == 0 {
+		return true
+	}
+	for _, after := range this.DumpAfter {
+		if after == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *PassManager) runPass(pass Pass, proc *Procedure) (*Procedure, error) {
+	start := time.Now()
+	newproc, err := pass.Run(this, proc)
+	this.Timings = append(this.Timings, PassTiming{
+		Pass:      pass.Name(),
+		Procedure: proc.name,
+		Duration:  time.Since(start),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if newproc != proc {
+		delete(this.cache, proc)
+	}
+	this.invalidate(newproc, pass.Preserves())
+
+	if this.dumpAfter(pass.Name()) {
+		fmt.Fprintf(this.Dump, "; after %s\n", pass.Name())
+		printproc(this.Dump, newproc)
+	}
+
+	if this.Verify {
+		if err := verify(newproc, this.Analysis(newproc, "dominators").(*dominatorTree)); err != nil {
+			return nil, errors.New(fmt.Sprintf("verification failed after %s: %s", pass.Name(), err))
+		}
+	}
+
+	return newproc, nil
+}
+
+// sets an option of the code generator that a pipeline gives as
+// key=value, such as regalloc=coloring
+func setOption(proc *Procedure, option string) error {
+	kv := strings.SplitN(option, "=", 2)
+	switch kv[0] {
+	case "regalloc":
+		if _, ok := registerAllocators[kv[1]]; !ok {
+			return errors.New(fmt.Sprintf("unknown register allocator %s", kv[1]))
+		}
+		proc.regalloc = kv[1]
+		return nil
+	case "schedule":
+		if _, ok := instructionSchedulers[kv[1]]; !ok {
+			return errors.New(fmt.Sprintf("unknown instruction scheduler %s", kv[1]))
+		}
+		proc.schedule = kv[1]
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("unknown option %s", kv[0]))
+	}
+}
+
+// RunPasses runs the named passes in order. names of the form key=value
+// set options of the code generator instead.
+func (this *PassManager) RunPasses(proc *Procedure, names []string) (*Procedure, error) {
+	for _, name := range names {
+		if strings.Contains(name, "=") {
+			if err := setOption(proc, name); err != nil {
+				return nil, err
+			}
+		} else if pass, ok := this.passes[name]; !ok {
+			return nil, errors.New(fmt.Sprintf("unknown pass %s", name))
+		} else if newproc, err := this.runPass(pass, proc); err != nil {
+			return nil, err
+		} else {
+			proc = newproc
+		}
+	}
+	return proc, nil
+}
+
+// Run runs the named pipeline such as -O1
+func (this *PassManager) Run(proc *Procedure, pipeline string) (*Procedure, error) {
+	if names, ok := this.pipelines[pipeline]; !ok {
+		return nil, errors.New(fmt.Sprintf("unknown pipeline %s", pipeline))
+	} else {
+		return this.RunPasses(proc, names)
+	}
+}
+
+// RunModule runs the named pipeline on every procedure of mod,
+// visiting callees before their callers
+func (this *PassManager) RunModule(mod *Module, pipeline string) error {
+	this.Module = mod
+
+	visited := map[*Procedure]struct{}{}
+	var recurse func(*Procedure) error
+	recurse = func(proc *Procedure) error {
+		if _, hasvisited := visited[proc]; hasvisited {
+			return nil
+		}
+		visited[proc] = struct{}{}
+		for _, blk := range proc.blocks {
+			for _, insr := range blk.instructions {
+				if insr.opcode != opcode_CALL {
+					continue
+				} else if callee := mod.lookup(insr.callee); callee != nil {
+					if err := recurse(callee); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if newproc, err := this.Run(proc, pipeline); err != nil {
+			return err
+		} else {
+			*proc = *newproc
+			return nil
+		}
+	}
+
+	for _, proc := range mod.procedures {
+		if err := recurse(proc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintTimings writes the total time spent in each pass
+func (this *PassManager) PrintTimings(w io.Writer) {
+	var names []string
+	totals := map[string]time.Duration{}
+	for _, timing := range this.Timings {
+		if _, ok := totals[timing.Pass]; !ok {
+			names = append(names, timing.Pass)
+		}
+		totals[timing.Pass] += timing.Duration
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%-12s %s\n", name, totals[name])
+	}
+}
+
+var builtinAnalyses = []Analysis{
+	&analysisFunc{"dominators", func(pm *PassManager, proc *Procedure) interface{} {
+		return dominators(proc)
+	}},
+	&analysisFunc{"liveness", func(pm *PassManager, proc *Procedure) interface{} {
+		return computeLiveness(proc)
+	}},
+	&analysisFunc{"reachingdefs", func(pm *PassManager, proc *Procedure) interface{} {
+		return computeReachingDefinitions(proc)
+	}},
+	&analysisFunc{"availexprs", func(pm *PassManager, proc *Procedure) interface{} {
+		return computeAvailableExpressions(proc)
+	}},
+}
+
+var cfgAnalyses = []string{"dominators"}
+
+var builtinPasses = []Pass{
+	&passFunc{"cfg", nil, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_BuildCFG(proc), nil
+	}},
+	&passFunc{"ssa", cfgAnalyses, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return reallycrudessa(proc)
+	}},
+	&passFunc{"copyprop", cfgAnalyses, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_CopyPropagation(proc), nil
+	}},
+	&passFunc{"simplify", cfgAnalyses, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_Simplify(proc), nil
+	}},
+	&passFunc{"prune", cfgAnalyses, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_PruneParams(proc), nil
+	}},
+	&passFunc{"tailrec", nil, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_TailRecursion(proc), nil
+	}},
+	&passFunc{"inline", nil, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		if pm.Module == nil {
+			return proc, nil
+		}
+		return Pass_Inline(proc, pm.Module, pm.InlineSize), nil
+	}},
+	&passFunc{"unroll", nil, func(pm *PassManager, proc *Procedure) (*Procedure, error) {
+		return Pass_Unroll(proc, pm.UnrollFactor, pm.UnrollSize), nil
+	}},
+}
+
+var builtinPipelines = map[string][]string{
+	"-O0": strings.Fields("cfg ssa"),
+	"-O1": strings.Fields("cfg ssa copyprop simplify prune tailrec schedule=list"),
+	"-O2": strings.Fields("cfg ssa copyprop simplify prune tailrec inline copyprop simplify prune unroll schedule=list regalloc=coloring"),
+}
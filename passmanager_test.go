@@ -0,0 +1,117 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassManager_Pipelines(t *testing.T) {
+	source := `
+	func square(x u64) u64 {
+		var y u64
+		entry:
+			mul y, x, x
+			ret y
+	}
+
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, square(b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}`
+
+	for _, pipeline := range []string{"-O0", "-O1", "-O2"} {
+		err := Compile(&Config{
+			Filename: "test.cubeasm",
+			Source:   source,
+			Module: func(mod *Module) error {
+				pm := NewPassManager()
+				pm.Verify = true
+				return pm.RunModule(mod, pipeline)
+			},
+		})
+
+		if err != nil {
+			t.Fatal(pipeline, err)
+		}
+	}
+}
+
+func TestPassManager_Dump(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		entry:
+			add a, a, 0
+			ret a
+	}`
+
+	var sb strings.Builder
+	pm := NewPassManager()
+	pm.Dump = &sb
+	pm.DumpAfter = []string{"simplify"}
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			_, err := pm.RunPasses(proc, []string{"cfg", "ssa", "simplify"})
+			return err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.HasPrefix(sb.String(), "; after simplify\n") {
+		t.Fatal(sb.String())
+	} else if !strings.Contains(sb.String(), "mov a.1, a.0") {
+		t.Fatal(sb.String())
+	} else if len(pm.Timings) != 3 {
+		t.Fatalf("wrong nr of timings")
+	}
+}
+
+func TestPassManager_AnalysisCache(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		entry:
+			jnz a, x, y
+		x:
+			ret 1
+		y:
+			ret 0
+	}`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			pm := NewPassManager()
+			proc, _ = pm.RunPasses(proc, []string{"cfg"})
+			domtree := pm.Analysis(proc, "dominators")
+			proc, _ = pm.RunPasses(proc, []string{"simplify"})
+			if pm.Analysis(proc, "dominators") != domtree {
+				t.Fatalf("dominators were not preserved")
+			}
+			proc, _ = pm.RunPasses(proc, []string{"cfg"})
+			if pm.Analysis(proc, "dominators") == domtree {
+				t.Fatalf("dominators were not invalidated")
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
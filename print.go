@@ -5,73 +5,133 @@ import (
 	"io"
 )
 
+func operandString(proc *Procedure, op operand) string {
+	if otype, val := op.unpack(); otype == operandType_CON {
+		return fmt.Sprintf("0x%x", proc.constants[val])
+	} else if otype == operandType_LOC {
+		return proc.locals[val].name
+	} else if otype == operandType_REG {
+		return fmt.Sprintf("%s", &proc.ssaregs[val])
+	} else {
+		return ""
+	}
+}
+
+// writes ops separated by commas
+func printOperands(w io.Writer, proc *Procedure, ops []operand) {
+	for i, op := range ops {
+		if i > 0 {
+			fmt.Fprintf(w, ", ")
+		}
+		fmt.Fprintf(w, "%s", operandString(proc, op))
+	}
+}
+
+func printInstruction(w io.Writer, proc *Procedure, insr *Instruction) {
+	var ops []operand
+	for _, op := range insr.operands {
+		if op.otype != operandType_NIL {
+			ops = append(ops, op)
+		}
+	}
+
+	fmt.Fprintf(w, "%s ", insr.opcode)
+	printOperands(w, proc, ops)
+	if insr.opcode == opcode_CALL {
+		fmt.Fprintf(w, ", %s(", insr.callee)
+		printOperands(w, proc, insr.arguments)
+		fmt.Fprintf(w, ")")
+	}
+}
+
+// writes the name of a successor and in ssa form the arguments passed to it.
+// the parentheses are left out if there are none because a procedure in ssa
+// form without registers cannot be told apart from one that is not.
+func printTarget(w io.Writer, proc *Procedure, blk *BasicBlock, succidx int) {
+	fmt.Fprintf(w, "%s", blk.successors[succidx])
+	if len(blk.jmpargs[succidx]) > 0 {
+		fmt.Fprintf(w, "(")
+		printOperands(w, proc, blk.jmpargs[succidx])
+		fmt.Fprintf(w, ")")
+	}
+}
+
+func printTerminator(w io.Writer, proc *Procedure, blk *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		fmt.Fprintf(w, "ret %s", operandString(proc, blk.jmpretval))
+	case opcode_JMP:
+		fmt.Fprintf(w, "jmp ")
+		printTarget(w, proc, blk, 0)
+	default:
+		fmt.Fprintf(w, "jnz %s, ", operandString(proc, blk.jmpretval))
+		printTarget(w, proc, blk, 0)
+		fmt.Fprintf(w, ", ")
+		printTarget(w, proc, blk, 1)
+	}
+}
+
+// writes the name of a block and in ssa form its parameters, if any
+func printBlockHeader(w io.Writer, proc *Procedure, blk *BasicBlock) {
+	fmt.Fprintf(w, "%s", blk)
+	if len(blk.ssaparams) > 0 {
+		var params []operand
+		for _, val := range blk.ssaparams {
+			params = append(params, operandReg(val))
+		}
+		fmt.Fprintf(w, "(")
+		printOperands(w, proc, params)
+		fmt.Fprintf(w, ")")
+	}
+	fmt.Fprintf(w, ":")
+}
+
+// printproc writes proc as cubeasm, or in the textual ssa form
+// described in ssaparse.go if proc is in ssa form
 func printproc(w io.Writer, proc *Procedure) {
 	fmt.Fprintf(w, "func %s(", proc.name)
 
-	funargidx := 0
-	for funargidx < len(proc.locals) && proc.locals[funargidx].isParameter {
-		local := &proc.locals[funargidx]
-		fmt.Fprintf(w, "%s, ", local)
-		funargidx += 1
+	funargidx := proc.numParameters()
+	for i := 0; i < funargidx; i++ {
+		if i > 0 {
+			fmt.Fprintf(w, ", ")
+		}
+		fmt.Fprintf(w, "%s", &proc.locals[i])
 	}
 
-	fmt.Fprintf(w, ") %s {\n", proc.returnType)
+	fmt.Fprintf(w, ") %s", proc.returnType)
+	if proc.callconv != "" {
+		fmt.Fprintf(w, " %s", proc.callconv)
+	}
+	fmt.Fprintf(w, " {\n")
 
 	for i := funargidx; i < len(proc.locals); i++ {
 		local := &proc.locals[i]
 		fmt.Fprintf(w, " var %s\n", local)
 	}
 
-	op2str := func(op operand) string {
-		if otype, val := op.unpack(); otype == operandType_CON {
-			return fmt.Sprintf("0x%x", proc.constants[val])
-		} else if otype == operandType_LOC {
-			return proc.locals[val].name
-		} else if otype == operandType_REG {
-			return fmt.Sprintf("%s", &proc.ssaregs[val])
-		} else {
-			return ""
-		}
-	}
-
 	for _, blk := range proc.blocks {
-		fmt.Fprintf(w, " %s(", blk)
-		for _, val := range blk.ssaparams {
-			fmt.Fprintf(w, "%s, ", &proc.ssaregs[val])
-		}
-		fmt.Fprintf(w, "):\n")
-
-		for _, insr := range blk.instructions {
-			fmt.Fprintf(w, "  %s ", insr.opcode)
-			for _, op := range insr.operands {
-				if op.otype != operandType_NIL {
-					fmt.Fprintf(w, "%s, ", op2str(op))
-				}
-			}
+		fmt.Fprintf(w, " ")
+		printBlockHeader(w, proc, blk)
+		fmt.Fprintf(w, "\n")
+
+		for i, _ := range blk.instructions {
+			fmt.Fprintf(w, "  ")
+			printInstruction(w, proc, &blk.instructions[i])
 			fmt.Fprintf(w, "\n")
 		}
 
-		switch blk.jmpcode {
-		case opcode_RET:
-			fmt.Fprintf(w, "  ret %s\n", op2str(blk.jmpretval))
-		case opcode_JMP:
-			fmt.Fprintf(w, "  jmp %s(", blk.successors[0])
-			for _, a := range blk.jmpargs[0] {
-				fmt.Fprintf(w, "%s, ", &proc.ssaregs[a])
-			}
-			fmt.Fprintf(w, ")\n")
-		default:
-			fmt.Fprintf(w, "  %s, %s(", op2str(blk.jmpretval), blk.successors[0])
-			for _, a := range blk.jmpargs[0] {
-				fmt.Fprintf(w, "%s, ", &proc.ssaregs[a])
-			}
-			fmt.Fprintf(w, "), %s(", blk.successors[1])
-			for _, a := range blk.jmpargs[1] {
-				fmt.Fprintf(w, "%s, ", &proc.ssaregs[a])
-			}
-			fmt.Fprintf(w, ")\n")
-		}
+		fmt.Fprintf(w, "  ")
+		printTerminator(w, proc, blk)
+		fmt.Fprintf(w, "\n")
 	}
 
 	fmt.Fprintf(w, "}\n")
 }
+
+// PrintModule writes every procedure of mod in textual form
+func PrintModule(w io.Writer, mod *Module) {
+	for _, proc := range mod.procedures {
+		printproc(w, proc)
+	}
+}
@@ -0,0 +1,36 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrint_Jnz(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+	entry:
+		jnz a, yes, no
+	yes:
+		ret 1
+	no:
+		ret 0
+	}`
+
+	var text string
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			var sb strings.Builder
+			printproc(&sb, proc)
+			text = sb.String()
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(text, "jnz a, yes") {
+		t.Fatal(text)
+	}
+}
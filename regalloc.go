@@ -0,0 +1,262 @@
+package cube
+
+import "sort"
+
+// an allocation maps every virtual register of a procedure to a location
+type allocation struct {
+	locations []location
+	// number of spill slots
+	nslots int
+	// the callee saved registers that are assigned to some value
+	calleeSaved []int
+}
+
+// returns the location of an operand, which is a register or a constant
+func (this *allocation) operand(op operand) location {
+	if otype, val := op.unpack(); otype == operandType_CON {
+		return location{location_CON, val}
+	} else if otype == operandType_REG {
+		return this.locations[val]
+	} else {
+		return location{}
+	}
+}
+
+// the registers a target hands to the allocator. values that are live
+// across a call cannot be assigned the registers that it clobbers.
+type registerSet struct {
+	callerSaved []int
+	calleeSaved []int
+	// returns the registers that a call changes, which are the caller
+	// saved registers if nil
+	clobbers func(call *Instruction) []int
+}
+
+// returns the registers that a machine instruction changes besides its
+// destination
+func (this *registerSet) clobbered(mi *machineInstr) []int {
+	if mi.opcode != machine_CALL {
+		return nil
+	} else if this.clobbers == nil {
+		return this.callerSaved
+	}
+	return this.clobbers(mi.ir)
+}
+
+// returns the callee saved registers that the prologue of mp must save,
+// which are those that are assigned and those that its calls clobber
+func (this *registerSet) toSave(mp *machineProc, used map[int]bool) []int {
+	saved := map[int]bool{}
+	for reg, ok := range used {
+		saved[reg] = ok
+	}
+	for _, mb := range mp.blocks {
+		for _, mi := range mb.instrs {
+			for _, reg := range this.clobbered(mi) {
+				saved[reg] = true
+			}
+		}
+	}
+
+	var result []int
+	for _, reg := range this.calleeSaved {
+		if saved[reg] {
+			result = append(result, reg)
+		}
+	}
+	return result
+}
+
+// a live interval spans the positions from the definition of a register
+// to its last use in the linear order of the blocks
+type interval struct {
+	reg   int
+	start int
+	end   int
+	// the registers that the calls it crosses clobber
+	clobbered map[int]bool
+	assigned  int
+}
+
+// numbers the positions of the blocks in order. a block starts with the
+// definition of its parameters followed by one position per machine
+// instruction and one for its terminator. temporaries never leave their
+// block so the liveness of the ir covers the ssa registers.
+func computeIntervals(mp *machineProc, regs *registerSet) []*interval {
+	live := computeLiveness(mp.proc)
+	intervals := make([]*interval, mp.nvregs)
+	var calls []int
+	var clobbers [][]int
+
+	extend := func(reg, pos int) {
+		if it := intervals[reg]; it == nil {
+			intervals[reg] = &interval{reg: reg, start: pos, end: pos, assigned: -1}
+		} else if pos < it.start {
+			it.start = pos
+		} else if pos > it.end {
+			it.end = pos
+		}
+	}
+
+	pos := 0
+	for _, mb := range mp.blocks {
+		blk := mb.block
+		start := pos
+		end := pos + len(mb.instrs) + 1
+
+		for _, val := range blk.ssaparams {
+			extend(val, start)
+		}
+		live.livein[blk].each(func(reg int) {
+			extend(reg, start)
+		})
+		live.liveout[blk].each(func(reg int) {
+			extend(reg, end)
+		})
+
+		for i, mi := range mb.instrs {
+			pos = start + 1 + i
+			if mi.opcode == machine_CALL {
+				calls = append(calls, pos)
+				clobbers = append(clobbers, regs.clobbered(mi))
+			}
+			if otype, val := mi.dst.unpack(); otype == operandType_REG {
+				extend(val, pos)
+			}
+			for _, src := range mi.srcs {
+				if otype, val := src.unpack(); otype == operandType_REG {
+					extend(val, pos)
+				}
+			}
+		}
+
+		blk.visitTerminatorUses(func(op *operand) {
+			if otype, val := op.unpack(); otype == operandType_REG {
+				extend(val, end)
+			}
+		})
+
+		pos = end + 1
+	}
+
+	var result []*interval
+	for _, it := range intervals {
+		if it == nil {
+			continue
+		}
+		it.clobbered = map[int]bool{}
+		for i, call := range calls {
+			if it.start < call && call < it.end {
+				for _, reg := range clobbers[i] {
+					it.clobbered[reg] = true
+				}
+			}
+		}
+		result = append(result, it)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].start < result[j].start
+	})
+	return result
+}
+
+// assigns registers with poletto and sarkar's linear scan. when no
+// register is free the interval that ends last is spilled.
+func linearScan(mp *machineProc, regs *registerSet) *allocation {
+	alloc := &allocation{
+		locations: make([]location, mp.nvregs),
+	}
+
+	free := map[int]bool{}
+	for _, reg := range regs.callerSaved {
+		free[reg] = true
+	}
+	for _, reg := range regs.calleeSaved {
+		free[reg] = true
+	}
+
+	used := map[int]bool{}
+	var active []*interval
+
+	spill := func(it *interval) {
+		it.assigned = -1
+		alloc.locations[it.reg] = location{location_STACK, alloc.nslots}
+		alloc.nslots += 1
+	}
+
+	assign := func(it *interval, reg int) {
+		it.assigned = reg
+		free[reg] = false
+		alloc.locations[it.reg] = regLocation(reg)
+		used[reg] = true
+		active = append(active, it)
+		sort.SliceStable(active, func(i, j int) bool {
+			return active[i].end < active[j].end
+		})
+	}
+
+	candidates := append(append([]int{}, regs.callerSaved...), regs.calleeSaved...)
+
+	for _, it := range computeIntervals(mp, regs) {
+		// expire the intervals that end before this one starts
+		for len(active) > 0 && active[0].end < it.start {
+			free[active[0].assigned] = true
+			active = active[1:]
+		}
+
+		reg := -1
+		for _, r := range candidates {
+			if free[r] && !it.clobbered[r] {
+				reg = r
+				break
+			}
+		}
+
+		if reg >= 0 {
+			assign(it, reg)
+			continue
+		}
+
+		// steal the register of the active interval that ends last
+		// if it ends after this one and its register is suitable
+		victim := -1
+		for i := len(active) - 1; i >= 0; i-- {
+			if !it.clobbered[active[i].assigned] {
+				victim = i
+				break
+			}
+		}
+
+		if victim >= 0 && active[victim].end > it.end {
+			stolen := active[victim]
+			reg := stolen.assigned
+			active = append(active[:victim], active[victim+1:]...)
+			spill(stolen)
+			assign(it, reg)
+		} else {
+			spill(it)
+		}
+	}
+
+	alloc.calleeSaved = regs.toSave(mp, used)
+	return alloc
+}
+
+// a registerAllocator assigns a location to every virtual register
+type registerAllocator func(mp *machineProc, regs *registerSet) *allocation
+
+// the allocators that a pipeline selects with regalloc=name
+var registerAllocators = map[string]registerAllocator{
+	"linear":   linearScan,
+	"coloring": graphColoring,
+}
+
+// allocates the registers of mp with the allocator selected for its
+// procedure, or with linear scan if none was
+func allocateRegisters(mp *machineProc, regs *registerSet) *allocation {
+	if allocator, ok := registerAllocators[mp.proc.regalloc]; ok {
+		return allocator(mp, regs)
+	}
+	return linearScan(mp, regs)
+}
@@ -0,0 +1,418 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// registers are numbered like the x registers and printed with their abi
+// names. t0 and t1 hold operands that are not in registers, t2 breaks
+// cycles of parallel moves and t3 carries values between two memory
+// locations.
+const (
+	riscv64_ZERO = 0
+	riscv64_RA   = 1
+	riscv64_SP   = 2
+	riscv64_T0   = 5
+	riscv64_T1   = 6
+	riscv64_T2   = 7
+	riscv64_FP   = 8
+	riscv64_A0   = 10
+	riscv64_T3   = 28
+)
+
+var riscv64Names = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+// the psabi passes the first eight arguments in a0 to a7 and the rest on
+// the stack, and returns the result in a0. preserve_most keeps every
+// register that the allocator hands out except a0 and the temporaries,
+// which the linker may change on the way to the callee.
+var riscv64CallingConvs = callingConvs{
+	"c": &CallingConv{
+		name:        "c",
+		argRegs:     []int{10, 11, 12, 13, 14, 15, 16, 17},
+		retReg:      riscv64_A0,
+		callerSaved: []int{10, 11, 12, 13, 14, 15, 16, 17, 29, 30, 31},
+		calleeSaved: []int{9, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27},
+		stackAlign:  16,
+	},
+	"preserve_most": &CallingConv{
+		name:        "preserve_most",
+		argRegs:     []int{10, 11, 12, 13, 14, 15, 16, 17},
+		retReg:      riscv64_A0,
+		callerSaved: []int{10, 29, 30, 31},
+		calleeSaved: []int{9, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 11, 12, 13, 14, 15, 16, 17},
+		stackAlign:  16,
+	},
+}
+
+type riscv64Emitter struct {
+	w     io.Writer
+	mod   *Module
+	proc  *Procedure
+	conv  *CallingConv
+	alloc *allocation
+	// the frame holds the outgoing stack arguments, then the spill slots,
+	// then the callee saved registers and finally the saved ra and s0.
+	// s0 points to the top of the frame where the incoming stack
+	// arguments begin.
+	outgoing  int
+	framesize int
+	labels    int
+}
+
+func (this *riscv64Emitter) emit(format string, args ...interface{}) {
+	fmt.Fprintf(this.w, "\t"+format+"\n", args...)
+}
+
+func (this *riscv64Emitter) label(blk *BasicBlock) string {
+	return fmt.Sprintf(".L%s_%s", this.proc.name, blk)
+}
+
+func (this *riscv64Emitter) newLabel() string {
+	this.labels += 1
+	return fmt.Sprintf(".L%s_%d", this.proc.name, this.labels)
+}
+
+func riscv64Reg(reg int) string {
+	return riscv64Names[reg]
+}
+
+// returns value sign extended from its lower 12 bits
+func signExtend12(value int64) int64 {
+	return value << 52 >> 52
+}
+
+var (
+	riscv64Op_ADD   = &machineOpcode{name: "add", format: "add $d, $0, $1"}
+	riscv64Op_ADDI  = &machineOpcode{name: "addi", format: "addi $d, $0, $i"}
+	riscv64Op_ADDIW = &machineOpcode{name: "addiw", format: "addiw $d, $0, $i"}
+	riscv64Op_LI    = &machineOpcode{name: "li", format: "addi $d, zero, $i"}
+	riscv64Op_LUI   = &machineOpcode{name: "lui", format: "lui $d, $x"}
+	riscv64Op_SUB   = &machineOpcode{name: "sub", format: "sub $d, $0, $1"}
+	riscv64Op_NEG   = &machineOpcode{name: "neg", format: "sub $d, zero, $0"}
+	riscv64Op_MUL   = &machineOpcode{name: "mul", format: "mul $d, $0, $1", latency: 3}
+	riscv64Op_SLL   = &machineOpcode{name: "sll", format: "sll $d, $0, $1"}
+	riscv64Op_SLLI  = &machineOpcode{name: "slli", format: "slli $d, $0, $i"}
+)
+
+// a step of loading a constant. the first step is lui or li and the
+// others take the register as their source.
+type riscv64Step struct {
+	opcode *machineOpcode
+	imm    int64
+}
+
+// returns the steps that load a 64-bit constant. values that fit in 32
+// bits take a lui and an addiw, larger ones are built from the upper bits
+// by shifting them left with slli and adding the lower twelve bits with
+// addi.
+func riscv64Constant(value int64) []riscv64Step {
+	lo := signExtend12(value)
+	if value == int64(int32(value)) {
+		hi := ((value + 0x800) >> 12) & 0xfffff
+		if hi == 0 {
+			return []riscv64Step{{riscv64Op_LI, lo}}
+		} else if lo == 0 {
+			return []riscv64Step{{riscv64Op_LUI, hi}}
+		}
+		return []riscv64Step{{riscv64Op_LUI, hi}, {riscv64Op_ADDIW, lo}}
+	}
+
+	hi := (value - lo) >> 12
+	shift := int64(12)
+	for hi&1 == 0 {
+		hi >>= 1
+		shift += 1
+	}
+
+	steps := append(riscv64Constant(hi), riscv64Step{riscv64Op_SLLI, shift})
+	if lo != 0 {
+		steps = append(steps, riscv64Step{riscv64Op_ADDI, lo})
+	}
+	return steps
+}
+
+func isImm12(value uint64) bool {
+	return int64(value) == signExtend12(int64(value))
+}
+
+func isNegImm12(value uint64) bool {
+	return isImm12(-value)
+}
+
+func isZero(value uint64) bool {
+	return value == 0
+}
+
+// rv64im has no instructions that compute more than one operation so
+// every tile covers a single instruction. the tiles differ in the
+// immediates and the zero register they take.
+var riscv64Rules = []iselRule{
+	{tree(opcode_MOV, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		for _, step := range riscv64Constant(int64(sel.constant(args[0]))) {
+			if step.opcode == riscv64Op_LI || step.opcode == riscv64Op_LUI {
+				sel.emit(step.opcode, dst, step.imm)
+			} else {
+				sel.emit(step.opcode, dst, step.imm, dst)
+			}
+		}
+	}},
+	{tree(opcode_ADD, leafReg, leafCon(isImm12)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_ADDI, dst, int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_ADD, leafCon(isImm12), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_ADDI, dst, int64(sel.constant(args[0])), args[1])
+	}},
+	{tree(opcode_SUB, leafReg, leafCon(isNegImm12)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_ADDI, dst, -int64(sel.constant(args[1])), args[0])
+	}},
+	{tree(opcode_SUB, leafCon(isZero), leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_NEG, dst, 0, args[1])
+	}},
+	{tree(opcode_SHL, leafReg, leafCon(nil)), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_SLLI, dst, int64(sel.constant(args[1])&63), args[0])
+	}},
+	{tree(opcode_ADD, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_ADD, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SUB, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_SUB, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_MUL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_MUL, dst, 0, args[0], args[1])
+	}},
+	{tree(opcode_SHL, leafReg, leafReg), func(sel *selector, dst operand, args []operand) {
+		sel.emit(riscv64Op_SLL, dst, 0, args[0], args[1])
+	}},
+}
+
+// loads a 64-bit constant into reg
+func (this *riscv64Emitter) constant(reg int, value int64) {
+	rd := riscv64Reg(reg)
+	for _, step := range riscv64Constant(value) {
+		this.emit("%s", step.opcode.text(rd, []string{rd}, step.imm))
+	}
+}
+
+// returns the address of a spill slot or an incoming stack argument
+func (this *riscv64Emitter) address(loc location) string {
+	if loc.kind == location_ARG {
+		return fmt.Sprintf("%d(s0)", 8*loc.index)
+	} else {
+		return fmt.Sprintf("%d(sp)", this.outgoing+8*loc.index)
+	}
+}
+
+// returns a register that holds the value at loc, loading it into
+// scratch if it is not in a register
+func (this *riscv64Emitter) use(loc location, scratch int) int {
+	switch loc.kind {
+	case location_REG:
+		return loc.index
+	case location_CON:
+		if this.proc.constants[loc.index] == 0 {
+			return riscv64_ZERO
+		}
+		this.constant(scratch, int64(this.proc.constants[loc.index]))
+	default:
+		this.emit("ld %s, %s", riscv64Reg(scratch), this.address(loc))
+	}
+	return scratch
+}
+
+// returns the register to compute a value for loc into
+func (this *riscv64Emitter) def(loc location) int {
+	if loc.kind == location_REG {
+		return loc.index
+	}
+	return riscv64_T0
+}
+
+// stores the value computed into reg by def to loc
+func (this *riscv64Emitter) store(loc location, reg int) {
+	if loc.kind != location_REG && loc.kind != location_NONE {
+		this.emit("sd %s, %s", riscv64Reg(reg), this.address(loc))
+	}
+}
+
+func (this *riscv64Emitter) move(dst, src location) {
+	if dst.kind == location_REG {
+		if src == dst {
+			return
+		} else if src.kind == location_REG {
+			this.emit("mv %s, %s", riscv64Reg(dst.index), riscv64Reg(src.index))
+		} else if reg := this.use(src, dst.index); reg != dst.index {
+			this.emit("mv %s, %s", riscv64Reg(dst.index), riscv64Reg(reg))
+		}
+	} else {
+		this.store(dst, this.use(src, riscv64_T3))
+	}
+}
+
+func (this *riscv64Emitter) moves(moves []move) {
+	for _, m := range sequentializeMoves(moves, regLocation(riscv64_T2)) {
+		this.move(m.dst, m.src)
+	}
+}
+
+func (this *riscv64Emitter) instruction(mi *machineInstr) {
+	switch mi.opcode {
+	case machine_MOV:
+		this.move(this.alloc.operand(mi.dst), this.alloc.operand(mi.srcs[0]))
+		return
+	case machine_CALL:
+		this.call(mi.ir)
+		return
+	}
+
+	scratch := []int{riscv64_T0, riscv64_T1}
+	var srcs []string
+	for i, src := range mi.srcs {
+		srcs = append(srcs, riscv64Reg(this.use(this.alloc.operand(src), scratch[i])))
+	}
+	dst := this.alloc.operand(mi.dst)
+	rd := this.def(dst)
+	this.emit("%s", mi.opcode.text(riscv64Reg(rd), srcs, mi.imm))
+	this.store(dst, rd)
+}
+
+func (this *riscv64Emitter) call(insr *Instruction) {
+	// stack arguments first, since the register moves may overwrite
+	// the registers that hold them
+	conv := riscv64CallingConvs.of(this.mod, insr.callee)
+	var moves []move
+	for i, arg := range insr.arguments {
+		src := this.alloc.operand(arg)
+		if i < len(conv.argRegs) {
+			moves = append(moves, move{regLocation(conv.argRegs[i]), src})
+		} else {
+			reg := this.use(src, riscv64_T3)
+			this.emit("sd %s, %d(sp)", riscv64Reg(reg), 8*(i-len(conv.argRegs)))
+		}
+	}
+	this.moves(moves)
+
+	this.emit("call %s", insr.callee)
+	this.move(this.alloc.operand(insr.operands[0]), regLocation(conv.retReg))
+}
+
+func (this *riscv64Emitter) prologue() {
+	this.emit("addi sp, sp, -%d", this.framesize)
+	this.emit("sd ra, %d(sp)", this.framesize-8)
+	this.emit("sd s0, %d(sp)", this.framesize-16)
+	this.emit("addi s0, sp, %d", this.framesize)
+	for i, reg := range this.alloc.calleeSaved {
+		this.emit("sd %s, %d(sp)", riscv64Reg(reg), this.outgoing+8*(this.alloc.nslots+i))
+	}
+
+	// move the arguments to the parameters of the entry point
+	var moves []move
+	params := this.proc.entryPoint.ssaparams
+	for i, src := range this.conv.parameters(len(params)) {
+		moves = append(moves, move{this.alloc.locations[params[i]], src})
+	}
+	this.moves(moves)
+}
+
+func (this *riscv64Emitter) epilogue() {
+	for i, reg := range this.alloc.calleeSaved {
+		this.emit("ld %s, %d(sp)", riscv64Reg(reg), this.outgoing+8*(this.alloc.nslots+i))
+	}
+	this.emit("ld ra, %d(sp)", this.framesize-8)
+	this.emit("ld s0, %d(sp)", this.framesize-16)
+	this.emit("addi sp, sp, %d", this.framesize)
+	this.emit("ret")
+}
+
+// emits the moves of the jump from blk to successor succidx followed
+// by a jump unless the successor is next
+func (this *riscv64Emitter) jump(blk *BasicBlock, succidx int, next *BasicBlock) {
+	this.moves(edgeMoves(this.proc, this.alloc, blk, succidx))
+	if succ := blk.successors[succidx]; succ != next {
+		this.emit("j %s", this.label(succ))
+	}
+}
+
+func (this *riscv64Emitter) terminator(blk *BasicBlock, next *BasicBlock) {
+	switch blk.jmpcode {
+	case opcode_RET:
+		this.move(regLocation(this.conv.retReg), this.alloc.operand(blk.jmpretval))
+		this.epilogue()
+	case opcode_JMP:
+		this.jump(blk, 0, next)
+	case opcode_JNZ:
+		rs := this.use(this.alloc.operand(blk.jmpretval), riscv64_T0)
+		if len(blk.successors[0].ssaparams) == 0 {
+			this.emit("bnez %s, %s", riscv64Reg(rs), this.label(blk.successors[0]))
+			this.jump(blk, 1, next)
+		} else {
+			taken := this.newLabel()
+			this.emit("bnez %s, %s", riscv64Reg(rs), taken)
+			this.jump(blk, 1, nil)
+			fmt.Fprintf(this.w, "%s:\n", taken)
+			this.jump(blk, 0, next)
+		}
+	}
+}
+
+func (this *riscv64Emitter) procedure() error {
+	if err := checkCodegen(this.proc); err != nil {
+		return err
+	}
+
+	order := codegenOrder(this.proc)
+	regs := riscv64CallingConvs.registers(this.mod, this.proc)
+	mp := selectInstructions(this.proc, order, riscv64Rules)
+	scheduleInstructions(mp, regs)
+	this.alloc = allocateRegisters(mp, regs)
+
+	this.conv = riscv64CallingConvs.of(this.mod, this.proc.name)
+	this.outgoing = riscv64CallingConvs.outgoing(this.mod, this.proc)
+	this.framesize = this.conv.align(this.outgoing + 8*(this.alloc.nslots+len(this.alloc.calleeSaved)) + 16)
+	if this.framesize > 2032 {
+		return errors.New(fmt.Sprintf("frame of procedure %s is too large", this.proc.name))
+	}
+
+	name := this.proc.name
+	fmt.Fprintf(this.w, "\t.globl %s\n", name)
+	fmt.Fprintf(this.w, "\t.type %s, @function\n", name)
+	fmt.Fprintf(this.w, "\t.p2align 2\n")
+	fmt.Fprintf(this.w, "%s:\n", name)
+	this.prologue()
+
+	for i, mb := range mp.blocks {
+		var next *BasicBlock
+		if i+1 < len(order) {
+			next = order[i+1]
+		}
+
+		fmt.Fprintf(this.w, "%s:\n", this.label(mb.block))
+		for _, mi := range mb.instrs {
+			this.instruction(mi)
+		}
+		this.terminator(mb.block, next)
+	}
+
+	fmt.Fprintf(this.w, "\t.size %s, .-%s\n", name, name)
+	return nil
+}
+
+// emitRISCV64 writes mod as gnu assembler source for rv64im following
+// the standard psabi calling convention. the procedures must be in ssa
+// form.
+func emitRISCV64(w io.Writer, mod *Module) error {
+	fmt.Fprintf(w, "\t.text\n")
+	for _, proc := range mod.procedures {
+		if err := (&riscv64Emitter{w: w, mod: mod, proc: proc}).procedure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmitRISCV64(t *testing.T) {
+	source := `
+	func nine(a u64, b u64, c u64, d u64, e u64, f u64, g u64, h u64, i u64) u64 {
+		entry:
+			ret i
+	}
+
+	func big() u64 {
+		entry:
+			ret 0x1234000000005678
+	}
+
+	func mid() u64 {
+		entry:
+			ret 0x7ffff800
+	}
+
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, nine(0, 0, 0, 0, 0, 0, 0, 0, b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}`
+
+	var text string
+	err := Compile(&Config{
+		Source: source,
+		Module: func(mod *Module) error {
+			if err := NewPassManager().RunModule(mod, "-O1"); err != nil {
+				return err
+			}
+			var sb strings.Builder
+			err := emitRISCV64(&sb, mod)
+			text = sb.String()
+			return err
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"\t.globl pow\n",
+		", 0(s0)\n",
+		"\taddi a0, zero, 1165\n\tslli a0, a0, 38\n\taddi a0, a0, 5\n\tslli a0, a0, 12\n\taddi a0, a0, 1656\n",
+		"\tlui a0, 0x80000\n\taddiw a0, a0, -2048\n",
+		"\tsd ",
+		", 0(sp)\n",
+		"\tcall nine\n",
+		"\tbnez ",
+		", -1\n",
+		"\tmul ",
+		"\taddi sp, sp, 16\n\tret\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Fatal(expected, text)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package cube
+
+// a node of the dependency graph of a block
+type scheduleNode struct {
+	instr *machineInstr
+	index int
+	// the nodes that must wait for this one and how many cycles
+	succs     []*scheduleNode
+	latencies []int
+	npreds    int
+	// the longest path in cycles from the start of this node to the end
+	// of the block
+	priority int
+	// the first cycle in which the operands of this node are ready
+	earliest int
+}
+
+func (this *scheduleNode) latency() int {
+	if this.instr.opcode.latency > 0 {
+		return this.instr.opcode.latency
+	}
+	return 1
+}
+
+func (this *scheduleNode) addEdge(succ *scheduleNode, latency int) {
+	this.succs = append(this.succs, succ)
+	this.latencies = append(this.latencies, latency)
+	succ.npreds += 1
+}
+
+// builds the dependency graph of the instructions of a block. an
+// instruction waits for the latency of those that define its sources and
+// for those that read or define its destination before it. calls stay in
+// place and nothing moves across them.
+func dependencies(instrs []*machineInstr) []*scheduleNode {
+	nodes := make([]*scheduleNode, len(instrs))
+	lastDef := map[int]*scheduleNode{}
+	usesSinceDef := map[int][]*scheduleNode{}
+	var barrier *scheduleNode
+	var sinceBarrier []*scheduleNode
+
+	for i, mi := range instrs {
+		node := &scheduleNode{instr: mi, index: i}
+		nodes[i] = node
+
+		if mi.opcode == machine_CALL {
+			for _, prev := range sinceBarrier {
+				prev.addEdge(node, prev.latency())
+			}
+			barrier, sinceBarrier = node, nil
+		} else if barrier != nil {
+			barrier.addEdge(node, barrier.latency())
+		}
+		sinceBarrier = append(sinceBarrier, node)
+
+		for _, src := range mi.srcs {
+			if otype, val := src.unpack(); otype == operandType_REG {
+				if def := lastDef[val]; def != nil {
+					def.addEdge(node, def.latency())
+				}
+				usesSinceDef[val] = append(usesSinceDef[val], node)
+			}
+		}
+
+		if otype, val := mi.dst.unpack(); otype == operandType_REG {
+			for _, use := range usesSinceDef[val] {
+				if use != node {
+					use.addEdge(node, 0)
+				}
+			}
+			if def := lastDef[val]; def != nil {
+				def.addEdge(node, 1)
+			}
+			lastDef[val] = node
+			usesSinceDef[val] = nil
+		}
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		node.priority = node.latency()
+		for j, succ := range node.succs {
+			if p := node.latencies[j] + succ.priority; p > node.priority {
+				node.priority = p
+			}
+		}
+	}
+
+	return nodes
+}
+
+// tracks the registers that are live while a block is scheduled from
+// top to bottom
+type schedulePressure struct {
+	live map[int]bool
+	// the uses of every register that are not scheduled yet
+	remaining map[int]int
+	liveout   bitset
+}
+
+// temporaries are never live out and have no bit in liveout
+func (this *schedulePressure) isLiveOut(val int) bool {
+	return val < len(this.liveout)*64 && this.liveout.has(val)
+}
+
+func (this *schedulePressure) stillNeeded(val int) bool {
+	return this.remaining[val] > 0 || this.isLiveOut(val)
+}
+
+// returns how many registers scheduling mi makes live minus how many it
+// frees
+func (this *schedulePressure) delta(mi *machineInstr) int {
+	delta := 0
+	uses := map[int]int{}
+	for _, src := range mi.srcs {
+		if otype, val := src.unpack(); otype == operandType_REG {
+			uses[val] += 1
+		}
+	}
+	for val, n := range uses {
+		if this.remaining[val] == n && !this.isLiveOut(val) {
+			delta -= 1
+		}
+	}
+	if otype, val := mi.dst.unpack(); otype == operandType_REG && !this.live[val] {
+		delta += 1
+	}
+	return delta
+}
+
+func (this *schedulePressure) schedule(mi *machineInstr) {
+	for _, src := range mi.srcs {
+		if otype, val := src.unpack(); otype == operandType_REG {
+			this.remaining[val] -= 1
+			if !this.stillNeeded(val) {
+				delete(this.live, val)
+			}
+		}
+	}
+	if otype, val := mi.dst.unpack(); otype == operandType_REG {
+		if this.stillNeeded(val) {
+			this.live[val] = true
+		} else {
+			delete(this.live, val)
+		}
+	}
+}
+
+// reorders the instructions of a block by list scheduling. every cycle
+// issues the ready instruction with the longest path to the end of the
+// block, or the one that frees the most registers once limit registers
+// are live. ties keep the original order.
+func scheduleBlock(mb *machineBlock, liveout bitset, limit int) {
+	nodes := dependencies(mb.instrs)
+
+	pressure := &schedulePressure{
+		live:      map[int]bool{},
+		remaining: map[int]int{},
+		liveout:   liveout,
+	}
+	for _, mi := range mb.instrs {
+		for _, src := range mi.srcs {
+			if otype, val := src.unpack(); otype == operandType_REG {
+				pressure.remaining[val] += 1
+			}
+		}
+	}
+	mb.block.visitTerminatorUses(func(op *operand) {
+		if otype, val := op.unpack(); otype == operandType_REG {
+			pressure.remaining[val] += 1
+		}
+	})
+	// the registers that are live at the start are those used in the
+	// block or live out of it that the block does not define
+	for val, _ := range pressure.remaining {
+		pressure.live[val] = true
+	}
+	liveout.each(func(val int) {
+		pressure.live[val] = true
+	})
+	for _, mi := range mb.instrs {
+		if otype, val := mi.dst.unpack(); otype == operandType_REG {
+			delete(pressure.live, val)
+		}
+	}
+
+	var ready []*scheduleNode
+	for _, node := range nodes {
+		if node.npreds == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	var scheduled []*machineInstr
+	for cycle := 0; len(ready) > 0; cycle += 1 {
+		best := -1
+		for i, node := range ready {
+			if node.earliest > cycle {
+				continue
+			} else if best < 0 {
+				best = i
+				continue
+			}
+
+			other := ready[best]
+			if len(pressure.live) >= limit {
+				if d, e := pressure.delta(node.instr), pressure.delta(other.instr); d != e {
+					if d < e {
+						best = i
+					}
+					continue
+				}
+			}
+			if node.priority > other.priority || node.priority == other.priority && node.index < other.index {
+				best = i
+			}
+		}
+
+		// nothing is ready in this cycle so wait
+		if best < 0 {
+			continue
+		}
+
+		node := ready[best]
+		ready = append(ready[:best], ready[best+1:]...)
+		scheduled = append(scheduled, node.instr)
+		pressure.schedule(node.instr)
+
+		for i, succ := range node.succs {
+			if c := cycle + node.latencies[i]; c > succ.earliest {
+				succ.earliest = c
+			}
+			succ.npreds -= 1
+			if succ.npreds == 0 {
+				ready = append(ready, succ)
+			}
+		}
+	}
+
+	mb.instrs = scheduled
+}
+
+// listSchedule schedules every block of mp on its own. the live
+// registers are limited to the registers that regs hands out.
+func listSchedule(mp *machineProc, regs *registerSet) {
+	live := computeLiveness(mp.proc)
+	limit := len(regs.callerSaved) + len(regs.calleeSaved)
+	for _, mb := range mp.blocks {
+		scheduleBlock(mb, live.liveout[mb.block], limit)
+	}
+}
+
+// the schedulers that a pipeline selects with schedule=name
+var instructionSchedulers = map[string]func(mp *machineProc, regs *registerSet){
+	"none": func(mp *machineProc, regs *registerSet) {},
+	"list": listSchedule,
+}
+
+// schedules the instructions of mp with the scheduler selected for its
+// procedure, or leaves them in order if none was
+func scheduleInstructions(mp *machineProc, regs *registerSet) {
+	if scheduler, ok := instructionSchedulers[mp.proc.schedule]; ok {
+		scheduler(mp, regs)
+	}
+}
@@ -0,0 +1,65 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListSchedule(t *testing.T) {
+	source := `
+	func f(a u64, b u64, c u64) u64 {
+		var p u64
+		entry:
+			mul p, a, b
+			add p, p, 1
+			sub c, c, 1
+			add p, p, c
+			ret p
+	}
+
+	func g(a u64, b u64, c u64) u64 {
+		var p u64
+		entry:
+			call c, f(c, c, c)
+			mul p, a, b
+			add p, p, p
+			add p, p, c
+			ret p
+	}`
+
+	for _, testcase := range []struct {
+		name     string
+		expected string
+	}{
+		// the sub hides the latency of the mul
+		{"f", "entry(a.0, b.0, c.0):\n\tmul p.0, a.0, b.0\n\taddi c.1, c.0, -1\n\taddi p.1, p.0, 1\n\tadd p.2, p.1, c.1\n\tret p.2\n"},
+		// the mul does not depend on the call but cannot move above it
+		{"g", "entry(a.0, b.0, c.0):\n\tcall c.1, f(c.0, c.0, c.0)\n\tmul p.0, a.0, b.0\n\tadd p.1, p.0, p.0\n\tadd p.2, p.1, c.1\n\tret p.2\n"},
+	} {
+		var text string
+		err := Compile(&Config{
+			Source: source,
+			Procedure: func(proc *Procedure) error {
+				if proc.name != testcase.name {
+					return nil
+				}
+				proc, err := NewPassManager().Run(proc, "-O1")
+				if err != nil {
+					return err
+				}
+				mp := selectInstructions(proc, codegenOrder(proc), riscv64Rules)
+				scheduleInstructions(mp, riscv64CallingConvs.registers(&Module{}, proc))
+				var sb strings.Builder
+				printMachineProc(&sb, mp)
+				text = sb.String()
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		} else if text != testcase.expected {
+			t.Fatal(testcase.name, text)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package cube
+
+import "math/bits"
+
+type operandPattern int
+
+const (
+	pattern_ANY operandPattern = iota
+	pattern_CON
+	pattern_NONCON
+	pattern_ZERO
+	pattern_ONE
+	pattern_POW2
+	pattern_SAME
+)
+
+// a simplifyRule rewrites an instruction when its opcode and source operands
+// match the rule. operand two is matched against op2, or compared with
+// operand one if op2 is pattern_SAME.
+type simplifyRule struct {
+	opcode  *opcode
+	op1     operandPattern
+	op2     operandPattern
+	rewrite func(proc *Procedure, insr Instruction) Instruction
+}
+
+var simplifyRules = []simplifyRule{
+	// constant folding
+	{opcode_ADD, pattern_CON, pattern_CON, rewrite_fold},
+	{opcode_SUB, pattern_CON, pattern_CON, rewrite_fold},
+	{opcode_MUL, pattern_CON, pattern_CON, rewrite_fold},
+	{opcode_SHL, pattern_CON, pattern_CON, rewrite_fold},
+
+	// constants go in the second operand of commutative instructions
+	{opcode_ADD, pattern_CON, pattern_NONCON, rewrite_swap},
+	{opcode_MUL, pattern_CON, pattern_NONCON, rewrite_swap},
+
+	// identities
+	{opcode_ADD, pattern_ANY, pattern_ZERO, rewrite_op1},
+	{opcode_SUB, pattern_ANY, pattern_ZERO, rewrite_op1},
+	{opcode_SUB, pattern_ANY, pattern_SAME, rewrite_zero},
+	{opcode_MUL, pattern_ANY, pattern_ONE, rewrite_op1},
+	{opcode_MUL, pattern_ANY, pattern_ZERO, rewrite_zero},
+	{opcode_SHL, pattern_ANY, pattern_ZERO, rewrite_op1},
+	{opcode_SHL, pattern_ZERO, pattern_ANY, rewrite_zero},
+
+	// strength reduction
+	{opcode_MUL, pattern_ANY, pattern_POW2, rewrite_shl},
+}
+
+func evaluate(opc *opcode, a, b uint64) uint64 {
+	switch opc {
+	case opcode_ADD:
+		return a + b
+	case opcode_SUB:
+		return a - b
+	case opcode_MUL:
+		return a * b
+	case opcode_SHL:
+		return a << (b & 63)
+	default:
+		panic("cannot evaluate " + opc.name)
+	}
+}
+
+func newMov(dst, src operand) Instruction {
+	return Instruction{
+		opcode:   opcode_MOV,
+		operands: [3]operand{dst, src, operandNil},
+	}
+}
+
+func rewrite_fold(proc *Procedure, insr Instruction) Instruction {
+	a := proc.constants[insr.operands[1].value]
+	b := proc.constants[insr.operands[2].value]
+	result := evaluate(insr.opcode, a, b)
+	return newMov(insr.operands[0], operandCon(proc.constant(result)))
+}
+
+func rewrite_swap(proc *Procedure, insr Instruction) Instruction {
+	insr.operands[1], insr.operands[2] = insr.operands[2], insr.operands[1]
+	return insr
+}
+
+func rewrite_op1(proc *Procedure, insr Instruction) Instruction {
+	return newMov(insr.operands[0], insr.operands[1])
+}
+
+func rewrite_zero(proc *Procedure, insr Instruction) Instruction {
+	return newMov(insr.operands[0], operandCon(proc.constant(0)))
+}
+
+func rewrite_shl(proc *Procedure, insr Instruction) Instruction {
+	shift := bits.TrailingZeros64(proc.constants[insr.operands[2].value])
+	insr.opcode = opcode_SHL
+	insr.operands[2] = operandCon(proc.constant(uint64(shift)))
+	return insr
+}
+
+func (this operandPattern) match(proc *Procedure, op, op1 operand) bool {
+	iscon := op.otype == operandType_CON
+	switch this {
+	case pattern_ANY:
+		return true
+	case pattern_CON:
+		return iscon
+	case pattern_NONCON:
+		return !iscon
+	case pattern_ZERO:
+		return iscon && proc.constants[op.value] == 0
+	case pattern_ONE:
+		return iscon && proc.constants[op.value] == 1
+	case pattern_POW2:
+		return iscon && bits.OnesCount64(proc.constants[op.value]) == 1
+	case pattern_SAME:
+		return op == op1
+	default:
+		return false
+	}
+}
+
+func simplify(proc *Procedure, insr Instruction) (Instruction, bool) {
+	for _, rule := range simplifyRules {
+		if rule.opcode == insr.opcode &&
+			rule.op1.match(proc, insr.operands[1], insr.operands[1]) &&
+			rule.op2.match(proc, insr.operands[2], insr.operands[1]) {
+			return rule.rewrite(proc, insr), true
+		}
+	}
+	return insr, false
+}
+
+// Pass_Simplify applies the algebraic identities and strength reductions
+// in simplifyRules to every instruction until none of them match.
+func Pass_Simplify(proc *Procedure) *Procedure {
+	for _, blk := range proc.blocks {
+		for i, _ := range blk.instructions {
+			for changed := true; changed; {
+				blk.instructions[i], changed = simplify(proc, blk.instructions[i])
+			}
+		}
+	}
+	return proc
+}
@@ -0,0 +1,49 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSimplify_1(t *testing.T) {
+	source := `
+	func f(a u64) u64 {
+		var b u64
+		entry:
+			add b, 0, a
+			mul b, b, 1
+			mul b, 8, b
+			sub b, b, b
+			mul b, 3, 4
+			ret b
+	}`
+
+	expected := []string{
+		"mov b, a",
+		"mov b, b",
+		"shl b, b, 0x3",
+		"mov b, 0x0",
+		"mov b, 0xc",
+	}
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_Simplify(proc)
+			var sb strings.Builder
+			printproc(&sb, proc)
+			lines := strings.Split(sb.String(), "\n")[3:8]
+			for i, line := range lines {
+				if strings.TrimSpace(line) != strings.TrimSpace(expected[i]) {
+					t.Fatalf("expected '%s' but got '%s'", expected[i], line)
+				}
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,33 @@
+package cube
+
+import "fmt"
+
+// a span is a range of bytes in the source together with the line and
+// column of its first byte. the zero span means the position is unknown.
+type span struct {
+	offset int
+	length int
+	lineno int
+	column int
+}
+
+func tokenSpan(token Token) span {
+	return span{
+		offset: token.Offset,
+		length: len(token.Value),
+		lineno: token.LineNo,
+		column: token.Column,
+	}
+}
+
+// extends the span up to the byte at offset end
+func (this span) to(end int) span {
+	if end > this.offset {
+		this.length = end - this.offset
+	}
+	return this
+}
+
+func (this span) String() string {
+	return fmt.Sprintf("%d:%d", this.lineno, this.column)
+}
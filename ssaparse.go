@@ -0,0 +1,106 @@
+package cube
+
+import "fmt"
+
+// the textual ssa form is what PrintModule writes for procedures in ssa
+// form and CompileSSA reads back, so that print(parse(x)) == x:
+//
+//	func pow(b u64, e u64) u64 {
+//	 var r u64
+//	 entry(b.0, e.0):
+//	  jmp loop(b.0, e.0, 0x1)
+//	 loop(b.1, e.1, r.1):
+//	  jnz e.1, body(b.1, e.1, r.1), done(r.1)
+//	 body(b.2, e.2, r.2):
+//	  mul r.3, r.2, b.2
+//	  sub e.3, e.2, 0x1
+//	  jmp loop(b.2, e.3, r.3)
+//	 done(r.4):
+//	  ret r.4
+//	}
+//
+// it is cubeasm with three differences. operands are registers written as
+// local.generation instead of locals, block headers list the registers
+// that the block takes as parameters, and jump targets are followed by
+// the arguments passed to those parameters. the parentheses are left out
+// of blocks without parameters. the first block is the entry point and
+// its parameters receive the arguments of the call.
+
+type ssaRegKey struct {
+	local      int
+	generation int
+}
+
+// CompileSSA is like Compile but reads procedures in the textual ssa form
+func CompileSSA(config *Config) error {
+	return (&parseContext{
+		config: config,
+		lexer:  NewLexer(config.Source),
+		ssa:    true,
+	}).parse()
+}
+
+// parses a register and creates it the first time it is seen
+func (this *parseContext) register() (operand, error) {
+	if local, err := this.local(); err != nil {
+		return operandNil, err
+	} else if _, err := this.expect(DOT); err != nil {
+		return operandNil, err
+	} else if gen, err := this.expect(INTEGER); err != nil {
+		return operandNil, err
+	} else if generation, err := parseInt(gen.Value); err != nil || generation >= 1<<31 {
+		return operandNil, this.errorAt(tokenSpan(gen), diag_INTEGER, fmt.Sprintf("invalid generation %s", gen.Value))
+	} else {
+		key := ssaRegKey{local, int(generation)}
+		if reg, ok := this.regdefs[key]; ok {
+			return operandReg(reg), nil
+		}
+
+		// locals are all declared before the first block
+		// so pointers into the slice stay valid
+		l := &this.curproc.locals[local]
+		if l.generations <= key.generation {
+			l.generations = key.generation + 1
+		}
+
+		reg := len(this.curproc.ssaregs)
+		this.curproc.ssaregs = append(this.curproc.ssaregs, SSAReg{
+			local:      l,
+			generation: key.generation,
+		})
+		this.regdefs[key] = reg
+		return operandReg(reg), nil
+	}
+}
+
+// parses the parameters of the current block in ssa form.
+// blocks without parameters may leave out the parentheses.
+func (this *parseContext) blockParameters() error {
+	if matched, err := this.match(PAREN_L); err != nil || !this.ssa || !matched {
+		return err
+	} else if args, err := this.arguments(); err != nil {
+		return err
+	} else {
+		for _, arg := range args {
+			if otype, val := arg.unpack(); otype != operandType_REG {
+				return this.error(diag_SYNTAX, "block parameters must be registers")
+			} else {
+				this.curblock.ssaparams = append(this.curblock.ssaparams, val)
+			}
+		}
+		return nil
+	}
+}
+
+// parses the arguments of a jump to successor succidx in ssa form.
+// jumps without arguments may leave out the parentheses.
+func (this *parseContext) jumpArguments(succidx int) error {
+	if matched, err := this.match(PAREN_L); err != nil || !this.ssa || !matched {
+		return err
+	} else if args, err := this.arguments(); err != nil {
+		return err
+	} else {
+		this.curblock.jmpargs[succidx] = args
+		return nil
+	}
+}
@@ -0,0 +1,180 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSSA_RoundTrip(t *testing.T) {
+	source := `
+	func square(x u64) u64 {
+		var y u64
+		entry:
+			mul y, x, x
+			ret y
+	}
+
+	func pow(b u64, e u64) u64 {
+		var r u64
+		var s u64
+		entry:
+			mov r, 1
+			jmp loop
+		loop:
+			jnz e, body, done
+		body:
+			call s, square(b)
+			mul r, r, s
+			sub e, e, 1
+			jmp loop
+		done:
+			ret r
+	}
+
+	func zero() u64 {
+		entry:
+			ret 0xffffffffffffffff
+	}
+
+	func seven() u64 {
+		var a u64
+		entry:
+			mov a, 7
+			ret a
+	}
+
+	func pick(x u64) u64 {
+		var c u64
+		entry:
+			mov c, 1
+			jnz c, yes, no
+		yes:
+			ret x
+		no:
+			ret 0
+	}`
+
+	for _, pipeline := range []string{"", "-O0", "-O1", "-O2"} {
+		var text string
+		err := Compile(&Config{
+			Source: source,
+			Module: func(mod *Module) error {
+				if pipeline != "" {
+					if err := NewPassManager().RunModule(mod, pipeline); err != nil {
+						return err
+					}
+				}
+				var sb strings.Builder
+				PrintModule(&sb, mod)
+				text = sb.String()
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compile := Compile
+		if pipeline != "" {
+			compile = CompileSSA
+		}
+
+		err = compile(&Config{
+			Source: text,
+			Module: func(mod *Module) error {
+				for _, proc := range mod.procedures {
+					if err := verify(proc, dominators(proc)); err != nil {
+						return err
+					}
+				}
+
+				var sb strings.Builder
+				if PrintModule(&sb, mod); sb.String() != text {
+					t.Fatalf("%s\n%s", text, sb.String())
+				}
+
+				if result, err := NewInterpreter(mod).Call("pow", 3, 4); err != nil || result != 6561 {
+					t.Fatal(pipeline, result, err)
+				} else if result, err := NewInterpreter(mod).Call("seven"); err != nil || result != 7 {
+					t.Fatal(pipeline, result, err)
+				} else if result, err := NewInterpreter(mod).Call("pick", 5); err != nil || result != 5 {
+					t.Fatal(pipeline, result, err)
+				}
+				return nil
+			},
+		})
+
+		if err != nil {
+			t.Fatal(pipeline, err)
+		}
+	}
+}
+
+func TestParseSSA_Pass(t *testing.T) {
+	source := `func f(a u64) u64 {
+ entry(a.0):
+  mov a.1, 0x2
+  mul a.2, a.0, a.1
+  jnz a.2, next(a.2), next(0x0)
+ next(a.3):
+  ret a.3
+}
+`
+
+	expected := `func f(a u64) u64 {
+ entry(a.0):
+  shl a.2, a.0, 0x1
+  jnz a.2, next(a.2), next(0x0)
+ next(a.3):
+  ret a.3
+}
+`
+
+	err := CompileSSA(&Config{
+		Source: source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_Simplify(Pass_CopyPropagation(proc))
+			var sb strings.Builder
+			if printproc(&sb, proc); sb.String() != expected {
+				t.Fatal(sb.String())
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSSA_Errors(t *testing.T) {
+	sources := map[string]string{
+		"test.cubeasm:3: unexpected symbol ','": `func f(a u64) u64 {
+ entry(a.0):
+  mov a, 0x1
+  ret a.0
+}`,
+		"test.cubeasm:2: block parameters must be registers": `func f(a u64) u64 {
+ entry(0x1):
+  ret a.0
+}`,
+		"test.cubeasm:3: undefined local 'b' referenced here": `func f(a u64) u64 {
+ entry(a.0):
+  jmp next(b.0)
+ next(a.1):
+  ret a.1
+}`,
+	}
+
+	for expected, source := range sources {
+		err := CompileSSA(&Config{
+			Filename: "test.cubeasm",
+			Source:   source,
+		})
+
+		if err == nil || err.Error() != expected {
+			t.Fatal(expected, err)
+		}
+	}
+}
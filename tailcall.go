@@ -0,0 +1,43 @@
+package cube
+
+// Pass_TailRecursion turns self calls whose result is immediately returned
+// into jumps to a loop header, passing the call arguments as the new block
+// arguments. the header is the old entry point, behind a fresh entry block
+// that takes the parameters. the procedure must be in ssa form, in which
+// nothing but the parameters is live on entry, so the header takes every
+// live local.
+func Pass_TailRecursion(proc *Procedure) *Procedure {
+	var header *BasicBlock
+
+	for _, blk := range proc.blocks {
+		last := len(blk.instructions) - 1
+		if last < 0 || blk.jmpcode != opcode_RET {
+			continue
+		} else if call := blk.instructions[last]; call.opcode != opcode_CALL || call.callee != proc.name {
+			continue
+		} else if call.operands[0] != blk.jmpretval {
+			continue
+		} else {
+			if header == nil {
+				header = proc.entryPoint
+				entry := splitEntryBlock(proc)
+				for _, val := range header.ssaparams {
+					ssaregidx := proc.newSSAReg(proc.ssaregs[val].local)
+					entry.ssaparams = append(entry.ssaparams, ssaregidx)
+					entry.jmpargs[0] = append(entry.jmpargs[0], operandReg(ssaregidx))
+				}
+			}
+
+			blk.instructions = blk.instructions[:last]
+			blk.jmpcode = opcode_JMP
+			blk.jmpretval = operandNil
+			blk.jmpargs = [2][]operand{call.arguments, nil}
+			blk.successors = [2]*BasicBlock{header, nil}
+		}
+	}
+
+	if header != nil {
+		return Pass_BuildCFG(proc)
+	}
+	return proc
+}
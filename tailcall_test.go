@@ -0,0 +1,148 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTailRecursion_1(t *testing.T) {
+	source := `
+	func gcd(a u64, b u64) u64 {
+		entry:
+			jnz b, rec, done
+		rec:
+			sub a, a, b
+			call a, gcd(b, a)
+			ret a
+		done:
+			ret a
+	}`
+
+	expected := `func gcd(a u64, b u64) u64 {
+ entry_1(a.5, b.3):
+  jmp entry(a.5, b.3)
+ entry(a.0, b.0):
+  jnz b.0, rec(a.0, b.0), done(a.0, b.0)
+ rec(a.2, b.2):
+  sub a.3, a.2, b.2
+  jmp entry(b.2, a.3)
+ done(a.1, b.1):
+  ret a.1
+}
+`
+
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			proc, _ = reallycrudessa(proc)
+			proc = Pass_CopyPropagation(proc)
+			proc = Pass_TailRecursion(proc)
+			var sb strings.Builder
+			printproc(&sb, proc)
+			if s := sb.String(); s != expected {
+				t.Fatal(s)
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailRecursion_Locals(t *testing.T) {
+	source := `
+	func f(n u64, acc u64) u64 {
+		var s u64
+		var r u64
+		entry:
+			add s, s, n
+			add acc, acc, s
+			jnz n, rec, done
+		rec:
+			sub n, n, 1
+			mul s, s, 2
+			call r, f(n, s)
+			ret r
+		done:
+			ret acc
+	}
+
+	func g(n u64, k u64) u64 {
+		var s u64
+		var r u64
+		entry:
+			add s, s, k
+			jnz k, dec, rec
+		dec:
+			sub k, k, 1
+			jmp entry
+		rec:
+			jnz n, more, done
+		more:
+			sub n, n, 1
+			call r, g(n, s)
+			ret r
+		done:
+			ret s
+	}`
+
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        source,
+		Uninitialized: CheckIgnore,
+		Module: func(mod *Module) error {
+			interp := NewInterpreter(mod)
+			var expected [][]uint64
+			for _, proc := range mod.procedures {
+				var results []uint64
+				for n := uint64(0); n < 3; n++ {
+					if res, err := interp.Call(proc.name, n, 3); err != nil {
+						return err
+					} else {
+						results = append(results, res)
+					}
+				}
+				expected = append(expected, results)
+			}
+
+			for i, proc := range mod.procedures {
+				proc = Pass_BuildCFG(proc)
+				if _, err := reallycrudessa(proc); err != nil {
+					return err
+				}
+
+				proc = Pass_TailRecursion(proc)
+				if len(proc.entryPoint.predecessors) > 0 {
+					t.Fatalf("%s: entry point has predecessors", proc.name)
+				}
+
+				for _, blk := range proc.blocks {
+					for _, insr := range blk.instructions {
+						if insr.opcode == opcode_CALL {
+							t.Fatalf("%s: call was not rewritten", proc.name)
+						}
+					}
+				}
+
+				for n := uint64(0); n < 3; n++ {
+					if res, err := interp.Call(proc.name, n, 3); err != nil {
+						return err
+					} else if res != expected[i][n] {
+						var sb strings.Builder
+						printproc(&sb, proc)
+						t.Fatalf("%s(%d, 3): expected %d but got %d\n%s", proc.name, n, expected[i][n], res, sb.String())
+					}
+				}
+			}
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,45 @@
+package cube
+
+import "io"
+
+// a Target turns an optimized module into the output of cube build
+type Target struct {
+	Name        string
+	Description string
+	Emit        func(w io.Writer, mod *Module) error
+}
+
+var targets = []*Target{
+	{"ir", "textual ir", func(w io.Writer, mod *Module) error {
+		PrintModule(w, mod)
+		return nil
+	}},
+	{"aarch64", "gnu assembler for aarch64 with the aapcs64 calling convention", emitAArch64},
+	{"riscv64", "gnu assembler for rv64im with the standard psabi calling convention", emitRISCV64},
+	{"amd64", "elf64 relocatable object for x86-64 with the system v calling convention", emitELF64},
+	{"go", "go source of package cube with one func per procedure", func(w io.Writer, mod *Module) error {
+		return PrintGo(w, mod, "cube")
+	}},
+	{"bytecode", "bytecode for the vm of cube run", func(w io.Writer, mod *Module) error {
+		if bc, err := CompileBytecode(mod); err != nil {
+			return err
+		} else {
+			_, err := bc.WriteTo(w)
+			return err
+		}
+	}},
+}
+
+// Targets returns every target that cube build can emit
+func Targets() []*Target {
+	return targets
+}
+
+func LookupTarget(name string) *Target {
+	for _, target := range targets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
@@ -14,6 +14,7 @@ const (
 	CURLY_R
 	COMMA
 	COLON
+	DOT
 
 	U64
 	IDENT
@@ -26,10 +27,16 @@ const (
 	SUB
 	MUL
 	VAR
+	CALL
+	SHL
 )
 
 type Token struct {
 	Type   TokenType
 	LineNo int
+	// Column is the one-based rune position of the token in its line
+	// and Offset the byte position of the token in the source
+	Column int
+	Offset int
 	Value  string
 }
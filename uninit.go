@@ -0,0 +1,68 @@
+package cube
+
+type uninitializedUse struct {
+	local int
+	span  span
+}
+
+// finds the reads of locals that are not assigned on every path from the
+// entry point using a forward must analysis of the assigned locals.
+// the procedure must not be in ssa form.
+func uninitializedUses(proc *Procedure) []uninitializedUse {
+	blocks := predecessors(reachable(proc.entryPoint, proc.blocks))
+
+	boundary := newBitset(len(proc.locals))
+	initial := newBitset(len(proc.locals))
+	for i, local := range proc.locals {
+		initial.set(i)
+		if local.isParameter {
+			boundary.set(i)
+		}
+	}
+
+	// assigns the locals written by blk and calls visit for every read
+	// of an unassigned local
+	assign := func(blk *BasicBlock, assigned bitset, visit func(local int, sp span)) {
+		check := func(sp span) func(op *operand) {
+			return func(op *operand) {
+				if otype, val := op.unpack(); otype == operandType_LOC && !assigned.has(val) {
+					visit(val, sp)
+				}
+			}
+		}
+
+		for i, _ := range blk.instructions {
+			insr := &blk.instructions[i]
+			insr.visitUses(check(insr.span))
+			if otype, val := insr.operands[0].unpack(); otype == operandType_LOC {
+				assigned.set(val)
+			}
+		}
+		blk.visitTerminatorUses(check(blk.jmpspan))
+	}
+
+	result := solveDataflow(proc, &dataflowProblem{
+		direction: dataflow_FORWARD,
+		boundary:  boundary,
+		initial:   initial,
+		join:      joinIntersect,
+		transfer: func(blk *BasicBlock, assigned bitset) bitset {
+			assign(blk, assigned, func(local int, sp span) {})
+			return assigned
+		},
+	})
+
+	var uses []uninitializedUse
+	seen := map[uninitializedUse]struct{}{}
+	for _, blk := range blocks {
+		assign(blk, result.in[blk].copy(), func(local int, sp span) {
+			use := uninitializedUse{local, sp}
+			if _, ok := seen[use]; !ok {
+				seen[use] = struct{}{}
+				uses = append(uses, use)
+			}
+		})
+	}
+
+	return uses
+}
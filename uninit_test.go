@@ -0,0 +1,52 @@
+package cube
+
+import "testing"
+
+const uninitializedSource = `
+	func f(a u64) u64 {
+		var b u64
+		var c u64
+		entry:
+			jnz a, x, y
+		x:
+			mov b, 1
+			jmp z
+		y:
+			mov c, 1
+			jmp z
+		z:
+			add c, b, a
+			ret c
+	}`
+
+func TestUninitialized_Error(t *testing.T) {
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        uninitializedSource,
+		Uninitialized: CheckError,
+	})
+
+	if err == nil || err.Error() != "test.cubeasm:14: local b may be used before it is assigned" {
+		t.Fatal(err)
+	}
+}
+
+func TestUninitialized_Warning(t *testing.T) {
+	var warnings []string
+	err := Compile(&Config{
+		Filename:      "test.cubeasm",
+		Source:        uninitializedSource,
+		Uninitialized: CheckWarn,
+		Warning: func(msg string) {
+			warnings = append(warnings, msg)
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if len(warnings) != 1 {
+		t.Fatal(warnings)
+	} else if warnings[0] != "test.cubeasm:14: warning: local b may be used before it is assigned" {
+		t.Fatal(warnings[0])
+	}
+}
@@ -0,0 +1,356 @@
+package cube
+
+// a loop is a strongly connected component of the cfg with a single header
+type loop struct {
+	header *BasicBlock
+	blocks []*BasicBlock
+	member map[*BasicBlock]struct{}
+}
+
+func (this *loop) contains(blk *BasicBlock) bool {
+	_, ok := this.member[blk]
+	return ok
+}
+
+func (this *loop) size() int {
+	size := 0
+	for _, blk := range this.blocks {
+		size += len(blk.instructions) + 1
+	}
+	return size
+}
+
+// finds the reducible loops of a procedure after Pass_BuildCFG
+func findLoops(proc *Procedure) []*loop {
+	var loops []*loop
+	components := map[int]*loop{}
+
+	for _, blk := range proc.blocks {
+		lp, ok := components[blk.sccomponent]
+		if !ok {
+			lp = &loop{member: map[*BasicBlock]struct{}{}}
+			components[blk.sccomponent] = lp
+			loops = append(loops, lp)
+		}
+		lp.blocks = append(lp.blocks, blk)
+		lp.member[blk] = struct{}{}
+	}
+
+	var result []*loop
+	for _, lp := range loops {
+		if len(lp.blocks) == 1 {
+			blk := lp.blocks[0]
+			if blk.successors[0] != blk && blk.successors[1] != blk {
+				continue
+			}
+		}
+
+		var headers []*BasicBlock
+		for _, blk := range lp.blocks {
+			isheader := blk == proc.entryPoint
+			for _, pred := range blk.predecessors {
+				isheader = isheader || !lp.contains(pred)
+			}
+			if isheader {
+				headers = append(headers, blk)
+			}
+		}
+
+		if len(headers) == 1 {
+			lp.header = headers[0]
+			result = append(result, lp)
+		}
+	}
+
+	return result
+}
+
+type unroller struct {
+	factor  int
+	maxsize int
+}
+
+// reports whether a register defined inside the loop is used outside of it
+func (this *unroller) escapes(proc *Procedure, lp *loop) bool {
+	defined := map[int]struct{}{}
+	for _, blk := range lp.blocks {
+		for _, val := range blk.ssaparams {
+			defined[val] = struct{}{}
+		}
+		for _, insr := range blk.instructions {
+			if otype, val := insr.operands[0].unpack(); otype == operandType_REG {
+				defined[val] = struct{}{}
+			}
+		}
+	}
+
+	escapes := false
+	for _, blk := range proc.blocks {
+		if !lp.contains(blk) {
+			blk.visitUses(func(op *operand) {
+				if otype, val := op.unpack(); otype == operandType_REG {
+					_, isdefined := defined[val]
+					escapes = escapes || isdefined
+				}
+			})
+		}
+	}
+	return escapes
+}
+
+// copies the blocks of a loop with fresh ssa registers. edges inside
+// the loop point to the copies, edges leaving the loop are kept.
+func (this *unroller) clone(proc *Procedure, lp *loop) map[*BasicBlock]*BasicBlock {
+	clones := map[*BasicBlock]*BasicBlock{}
+	ssaregidxs := map[int]int{}
+
+	define := func(ssaregidx int) int {
+		newidx := proc.newSSAReg(proc.ssaregs[ssaregidx].local)
+		ssaregidxs[ssaregidx] = newidx
+		return newidx
+	}
+
+	rename := func(op operand) operand {
+		if otype, val := op.unpack(); otype != operandType_REG {
+			return op
+		} else if newidx, ok := ssaregidxs[val]; ok {
+			return operandReg(newidx)
+		} else {
+			return op
+		}
+	}
+
+	for _, blk := range lp.blocks {
+		clone := &BasicBlock{
+			name:         proc.newBlockName(blk.name),
+			instructions: append([]Instruction{}, blk.instructions...),
+			jmpcode:      blk.jmpcode,
+		}
+		for _, val := range blk.ssaparams {
+			clone.ssaparams = append(clone.ssaparams, define(val))
+		}
+		for i, insr := range clone.instructions {
+			if otype, val := insr.operands[0].unpack(); otype == operandType_REG {
+				clone.instructions[i].operands[0] = operandReg(define(val))
+			}
+		}
+		clones[blk] = clone
+		proc.blocks = append(proc.blocks, clone)
+	}
+
+	for _, blk := range lp.blocks {
+		clone := clones[blk]
+		for i, _ := range clone.instructions {
+			insr := &clone.instructions[i]
+			insr.arguments = append([]operand{}, insr.arguments...)
+			insr.visitUses(func(op *operand) {
+				*op = rename(*op)
+			})
+		}
+
+		clone.jmpretval = rename(blk.jmpretval)
+		for i, succ := range blk.successors {
+			if succ == nil {
+				continue
+			} else if lp.contains(succ) {
+				clone.successors[i] = clones[succ]
+			} else {
+				clone.successors[i] = succ
+			}
+			for _, arg := range blk.jmpargs[i] {
+				clone.jmpargs[i] = append(clone.jmpargs[i], rename(arg))
+			}
+		}
+	}
+
+	return clones
+}
+
+func redirect(blk, from, to *BasicBlock) {
+	for i, succ := range blk.successors {
+		if succ == from {
+			blk.successors[i] = to
+		}
+	}
+}
+
+// peels the first iteration off the loop. every entry into the loop now
+// goes through the copy, which falls back into the original header.
+func (this *unroller) peel(proc *Procedure, lp *loop) {
+	clones := this.clone(proc, lp)
+	header := clones[lp.header]
+
+	isclone := map[*BasicBlock]struct{}{}
+	for _, clone := range clones {
+		isclone[clone] = struct{}{}
+	}
+
+	for _, blk := range proc.blocks {
+		if _, ok := isclone[blk]; ok {
+			redirect(blk, header, lp.header)
+		} else if !lp.contains(blk) {
+			redirect(blk, lp.header, header)
+		}
+	}
+
+	if proc.entryPoint == lp.header {
+		proc.entryPoint = header
+	}
+}
+
+// chains factor copies of the loop body through their back edges
+func (this *unroller) unroll(proc *Procedure, lp *loop, factor int) {
+	latches := lp.blocks
+	for i := 1; i < factor; i++ {
+		clones := this.clone(proc, lp)
+		header := clones[lp.header]
+		for _, blk := range latches {
+			redirect(blk, lp.header, header)
+		}
+
+		latches = nil
+		for _, clone := range clones {
+			latches = append(latches, clone)
+			redirect(clone, header, lp.header)
+		}
+	}
+}
+
+// finds the number of iterations of loops of the form
+//
+//	header(.., n, ..):
+//	  jnz n, body, exit
+//
+// where n is a constant on entry and decremented by a constant step
+// along the single back edge. jnz takes its first successor when n is
+// not zero.
+func (this *unroller) tripCount(proc *Procedure, lp *loop) (uint64, bool) {
+	header := lp.header
+	if header.jmpcode != opcode_JNZ || header == proc.entryPoint {
+		return 0, false
+	} else if !lp.contains(header.successors[0]) || lp.contains(header.successors[1]) {
+		return 0, false
+	}
+
+	paramidx := -1
+	for i, val := range header.ssaparams {
+		if header.jmpretval == operandReg(val) {
+			paramidx = i
+		}
+	}
+	if paramidx < 0 {
+		return 0, false
+	}
+
+	argument := func(pred, blk *BasicBlock, index int) operand {
+		if pred.successors[0] == blk {
+			return pred.jmpargs[0][index]
+		} else {
+			return pred.jmpargs[1][index]
+		}
+	}
+
+	var entries, latches []*BasicBlock
+	for _, pred := range header.predecessors {
+		if lp.contains(pred) {
+			latches = append(latches, pred)
+		} else {
+			entries = append(entries, pred)
+		}
+	}
+	if len(entries) != 1 || len(latches) != 1 {
+		return 0, false
+	}
+
+	initial := argument(entries[0], header, paramidx)
+	if initial.otype != operandType_CON {
+		return 0, false
+	}
+
+	definitions := map[int]Instruction{}
+	parameters := map[int]*BasicBlock{}
+	for _, blk := range lp.blocks {
+		for _, val := range blk.ssaparams {
+			parameters[val] = blk
+		}
+		for _, insr := range blk.instructions {
+			if otype, val := insr.operands[0].unpack(); otype == operandType_REG {
+				definitions[val] = insr
+			}
+		}
+	}
+
+	// walk the definitions of the value on the back edge back to the header
+	step := uint64(0)
+	op := argument(latches[0], header, paramidx)
+	for limit := lp.size(); limit > 0; limit-- {
+		if op.otype != operandType_REG {
+			return 0, false
+		} else if insr, ok := definitions[op.value]; ok {
+			if insr.opcode != opcode_SUB || insr.operands[2].otype != operandType_CON {
+				return 0, false
+			}
+			step += proc.constants[insr.operands[2].value]
+			op = insr.operands[1]
+		} else if blk, ok := parameters[op.value]; !ok {
+			return 0, false
+		} else if blk == header {
+			if op != operandReg(header.ssaparams[paramidx]) {
+				return 0, false
+			}
+			n := proc.constants[initial.value]
+			if step == 0 || n%step != 0 {
+				return 0, false
+			}
+			return n / step, true
+		} else if len(blk.predecessors) != 1 {
+			return 0, false
+		} else {
+			for i, val := range blk.ssaparams {
+				if op.value == val {
+					op = argument(blk.predecessors[0], blk, i)
+					break
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func (this *unroller) run(proc *Procedure) *Procedure {
+	for _, lp := range findLoops(proc) {
+		predecessors(proc.blocks)
+		if this.escapes(proc, lp) {
+			continue
+		} else if trips, ok := this.tripCount(proc, lp); ok && trips < uint64(this.maxsize/lp.size()) {
+			// the peeled copies and the remaining loop fit in maxsize,
+			// compared without multiplying so large counts cannot wrap
+			for i := uint64(0); i < trips; i++ {
+				this.peel(proc, lp)
+			}
+
+			// the loop is now entered with a trip count of zero
+			header := lp.header
+			header.jmpcode = opcode_JMP
+			header.jmpretval = operandNil
+			header.successors = [2]*BasicBlock{header.successors[1], nil}
+			header.jmpargs = [2][]operand{header.jmpargs[1], nil}
+		} else if this.factor > 1 && (this.factor+1)*lp.size() <= this.maxsize {
+			this.peel(proc, lp)
+			this.unroll(proc, lp, this.factor)
+		}
+	}
+
+	return Pass_BuildCFG(proc)
+}
+
+// Pass_Unroll fully unrolls loops with a constant trip count and peels the
+// first iteration off other loops before unrolling them by factor.
+// no loop grows beyond maxsize instructions. the procedure must be in ssa form.
+func Pass_Unroll(proc *Procedure, factor, maxsize int) *Procedure {
+	return (&unroller{
+		factor:  factor,
+		maxsize: maxsize,
+	}).run(proc)
+}
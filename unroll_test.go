@@ -0,0 +1,110 @@
+package cube
+
+import (
+	"strings"
+	"testing"
+)
+
+func unrollTest(t *testing.T, source string, check func(proc *Procedure)) {
+	err := Compile(&Config{
+		Filename: "test.cubeasm",
+		Source:   source,
+		Procedure: func(proc *Procedure) error {
+			proc = Pass_BuildCFG(proc)
+			proc, _ = reallycrudessa(proc)
+			proc = Pass_CopyPropagation(proc)
+			check(Pass_Unroll(proc, 2, 64))
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnroll_Full(t *testing.T) {
+	source := `
+	func cube(b u64) u64 {
+	var e u64
+	var r u64
+	entry:
+		mov e, 3
+		mov r, 1
+		jmp loop
+	loop:
+		jnz e, body, done
+	body:
+		mul r, r, b
+		sub e, e, 1
+		jmp loop
+	done:
+		ret r
+	}`
+
+	unrollTest(t, source, func(proc *Procedure) {
+		if len(findLoops(proc)) != 0 {
+			t.Fatalf("loop was not unrolled")
+		} else if len(proc.blocks) != 9 {
+			t.Fatalf("wrong nr of blocks")
+		}
+	})
+}
+
+func TestUnroll_Partial(t *testing.T) {
+	source := `
+	func pow(b u64, e u64) u64 {
+	var r u64
+	entry:
+		mov r, 1
+		jmp loop
+	loop:
+		jnz e, body, done
+	body:
+		mul r, r, b
+		sub e, e, 1
+		jmp loop
+	done:
+		ret r
+	}`
+
+	unrollTest(t, source, func(proc *Procedure) {
+		if loops := findLoops(proc); len(loops) != 1 {
+			t.Fatalf("wrong nr of loops")
+		} else if len(loops[0].blocks) != 4 {
+			t.Fatalf("loop was not unrolled")
+		} else if len(proc.blocks) != 8 {
+			t.Fatalf("wrong nr of blocks")
+		}
+	})
+}
+
+func TestUnroll_HugeTripCount(t *testing.T) {
+	source := `
+	func f(b u64) u64 {
+	var e u64
+	var r u64
+	entry:
+		mov e, 0x7fffffffffffffff
+		mov r, 1
+		jmp loop
+	loop:
+		jnz e, body, done
+	body:
+		mul r, r, b
+		sub e, e, 1
+		jmp loop
+	done:
+		ret r
+	}`
+
+	for _, count := range []string{"0x7fffffffffffffff", "0xffffffffffffffff"} {
+		unrollTest(t, strings.Replace(source, "0x7fffffffffffffff", count, 1), func(proc *Procedure) {
+			if loops := findLoops(proc); len(loops) != 1 {
+				t.Fatalf("wrong nr of loops")
+			} else if procedureSize(proc) > 64 {
+				t.Fatalf("loop was fully unrolled")
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+)
+
+type verifier struct {
+	proc    *Procedure
+	domtree *dominatorTree
+	isssa   bool
+	defs    map[int]*BasicBlock
+	defidx  map[int]int
+}
+
+func (this *verifier) error(blk *BasicBlock, errmsg string) error {
+	return errors.New(fmt.Sprintf("%s: %s: %s", this.proc.name, blk, errmsg))
+}
+
+func (this *verifier) define(blk *BasicBlock, index int, op operand) error {
+	if otype, val := op.unpack(); otype != operandType_REG {
+		return this.operand(blk, op)
+	} else if err := this.operand(blk, op); err != nil {
+		return err
+	} else if _, exists := this.defs[val]; exists {
+		return this.error(blk, fmt.Sprintf("register %s is defined more than once", &this.proc.ssaregs[val]))
+	} else {
+		this.defs[val] = blk
+		this.defidx[val] = index
+		return nil
+	}
+}
+
+func (this *verifier) operand(blk *BasicBlock, op operand) error {
+	limit := 0
+	switch op.otype {
+	case operandType_NIL:
+		return nil
+	case operandType_LOC:
+		if this.isssa {
+			return this.error(blk, "local operand in ssa form")
+		}
+		limit = len(this.proc.locals)
+	case operandType_REG:
+		limit = len(this.proc.ssaregs)
+	case operandType_CON:
+		limit = len(this.proc.constants)
+	}
+
+	if op.value < 0 || op.value >= limit {
+		return this.error(blk, fmt.Sprintf("operand %d out of range", op.value))
+	}
+	return nil
+}
+
+// checks that the definition of a register dominates its use at index
+func (this *verifier) use(blk *BasicBlock, index int, op operand) error {
+	if otype, val := op.unpack(); otype != operandType_REG {
+		return nil
+	} else if defblk, ok := this.defs[val]; !ok {
+		return this.error(blk, fmt.Sprintf("register %s is never defined", &this.proc.ssaregs[val]))
+	} else if defblk == blk && this.defidx[val] >= index {
+		return this.error(blk, fmt.Sprintf("register %s is used before it is defined", &this.proc.ssaregs[val]))
+	} else if !this.domtree.dominates(defblk, blk) {
+		return this.error(blk, fmt.Sprintf("register %s does not dominate its use", &this.proc.ssaregs[val]))
+	} else {
+		return nil
+	}
+}
+
+func (this *verifier) terminator(blk *BasicBlock) error {
+	switch blk.jmpcode {
+	case opcode_RET:
+		if blk.successors[0] != nil || blk.successors[1] != nil {
+			return this.error(blk, "ret has successors")
+		}
+	case opcode_JMP:
+		if blk.successors[0] == nil || blk.successors[1] != nil {
+			return this.error(blk, "jmp must have one successor")
+		}
+	case opcode_JNZ:
+		if blk.successors[0] == nil || blk.successors[1] == nil {
+			return this.error(blk, "jnz must have two successors")
+		}
+	default:
+		return this.error(blk, "block has no terminator")
+	}
+
+	if this.isssa {
+		for i, succ := range blk.successors {
+			if succ != nil && len(blk.jmpargs[i]) != len(succ.ssaparams) {
+				errmsg := fmt.Sprintf("%d arguments passed to %s which has %d parameters",
+					len(blk.jmpargs[i]), succ, len(succ.ssaparams))
+				return this.error(blk, errmsg)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (this *verifier) verify() error {
+	for _, blk := range this.proc.blocks {
+		for _, val := range blk.ssaparams {
+			if err := this.define(blk, -1, operandReg(val)); err != nil {
+				return err
+			}
+		}
+		for i, insr := range blk.instructions {
+			if err := this.define(blk, i, insr.operands[0]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, blk := range this.proc.blocks {
+		if err := this.terminator(blk); err != nil {
+			return err
+		}
+
+		var err error
+		blk.visitUses(func(op *operand) {
+			if err == nil {
+				err = this.operand(blk, *op)
+			}
+		})
+		if err != nil {
+			return err
+		} else if !this.isssa {
+			continue
+		}
+
+		for i, _ := range blk.instructions {
+			blk.instructions[i].visitUses(func(op *operand) {
+				if err == nil {
+					err = this.use(blk, i, *op)
+				}
+			})
+		}
+		if err != nil {
+			return err
+		}
+
+		index := len(blk.instructions)
+		if err = this.use(blk, index, blk.jmpretval); err != nil {
+			return err
+		}
+		for _, args := range blk.jmpargs {
+			for _, arg := range args {
+				if err = this.use(blk, index, arg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// verify checks the structural invariants of a procedure. procedures with
+// ssa registers must also satisfy the ssa invariants.
+func verify(proc *Procedure, domtree *dominatorTree) error {
+	return (&verifier{
+		proc:    proc,
+		domtree: domtree,
+		isssa:   len(proc.ssaregs) > 0,
+		defs:    map[int]*BasicBlock{},
+		defidx:  map[int]int{},
+	}).verify()
+}
@@ -0,0 +1,152 @@
+package cube
+
+import (
+	"errors"
+	"fmt"
+)
+
+// the stack of the VM holds 8 MiB of slots by default like a thread
+const vmMaxStack = 1 << 20
+
+// VM executes Bytecode. the frames of all active procedures are kept in
+// one stack of slots and calls do not recurse in Go.
+type VM struct {
+	Bytecode *Bytecode
+	// MaxSteps aborts a call after this many instructions if positive
+	MaxSteps int
+	// MaxStack aborts a call when the frames of the active procedures
+	// need more than this many slots if positive, which limits the
+	// depth of recursion
+	MaxStack int
+}
+
+func NewVM(bc *Bytecode) *VM {
+	return &VM{
+		Bytecode: bc,
+		MaxStack: vmMaxStack,
+	}
+}
+
+// a suspended caller
+type vmFrame struct {
+	proc int
+	pc   int
+	fp   int
+	dst  int
+}
+
+// Call runs the named procedure with args and returns its result
+func (this *VM) Call(name string, args ...uint64) (uint64, error) {
+	procs, code := this.Bytecode.procs, this.Bytecode.code
+
+	index := this.Bytecode.lookup(name)
+	if index < 0 {
+		return 0, errors.New(fmt.Sprintf("undefined procedure %s", name))
+	} else if nparams := procs[index].nparams; nparams != len(args) {
+		return 0, errors.New(fmt.Sprintf("procedure %s takes %d arguments but %d were given", name, nparams, len(args)))
+	}
+
+	overflow := func(need int) bool {
+		return this.MaxStack > 0 && need > this.MaxStack
+	}
+
+	proc := &procs[index]
+	if overflow(proc.framesize + proc.outgoing) {
+		return 0, errors.New(fmt.Sprintf("procedure %s overflowed the stack of %d slots", name, this.MaxStack))
+	}
+	stack := make([]uint64, proc.framesize+proc.outgoing)
+	copy(stack, args)
+
+	var frames []vmFrame
+	pc, fp, steps := proc.offset, 0, 0
+	imm := func(at int) uint64 {
+		return uint64(code[at]) | uint64(code[at+1])<<32
+	}
+
+	for {
+		if steps += 1; this.MaxSteps > 0 && steps > this.MaxSteps {
+			return 0, errors.New(fmt.Sprintf("procedure %s exceeded %d steps", name, this.MaxSteps))
+		}
+
+		word := code[pc]
+		frame := stack[fp : fp+proc.framesize]
+		a := word >> 8
+
+		switch bytecodeOpcode(word & 0xff) {
+		case bytecode_MOV:
+			frame[a] = frame[code[pc+1]]
+			pc += 2
+		case bytecode_MOVI:
+			frame[a] = imm(pc + 1)
+			pc += 3
+		case bytecode_ADD:
+			frame[a] = frame[code[pc+1]] + frame[code[pc+2]]
+			pc += 3
+		case bytecode_ADDI:
+			frame[a] = frame[code[pc+1]] + imm(pc+2)
+			pc += 4
+		case bytecode_SUB:
+			frame[a] = frame[code[pc+1]] - frame[code[pc+2]]
+			pc += 3
+		case bytecode_SUBI:
+			frame[a] = frame[code[pc+1]] - imm(pc+2)
+			pc += 4
+		case bytecode_MUL:
+			frame[a] = frame[code[pc+1]] * frame[code[pc+2]]
+			pc += 3
+		case bytecode_MULI:
+			frame[a] = frame[code[pc+1]] * imm(pc+2)
+			pc += 4
+		case bytecode_SHL:
+			frame[a] = frame[code[pc+1]] << (frame[code[pc+2]] & 63)
+			pc += 3
+		case bytecode_SHLI:
+			frame[a] = frame[code[pc+1]] << (imm(pc+2) & 63)
+			pc += 4
+		case bytecode_ARG:
+			stack[fp+proc.framesize+int(a)] = frame[code[pc+1]]
+			pc += 2
+		case bytecode_ARGI:
+			stack[fp+proc.framesize+int(a)] = imm(pc + 1)
+			pc += 3
+		case bytecode_CALL:
+			frames = append(frames, vmFrame{index, pc + 2, fp, int(a)})
+			fp += proc.framesize
+			index = int(code[pc+1])
+			proc = &procs[index]
+			pc = proc.offset
+			if need := fp + proc.framesize + proc.outgoing; overflow(need) {
+				return 0, errors.New(fmt.Sprintf("procedure %s overflowed the stack of %d slots", name, this.MaxStack))
+			} else if need > len(stack) {
+				size := need + len(stack)/2
+				if this.MaxStack > 0 && size > this.MaxStack {
+					size = this.MaxStack
+				}
+				stack = append(stack, make([]uint64, size-len(stack))...)
+			}
+		case bytecode_JMP:
+			pc = int(code[pc+1])
+		case bytecode_JNZ:
+			if frame[a] != 0 {
+				pc = int(code[pc+1])
+			} else {
+				pc += 2
+			}
+		case bytecode_RET, bytecode_RETI:
+			var result uint64
+			if bytecodeOpcode(word&0xff) == bytecode_RET {
+				result = frame[a]
+			} else {
+				result = imm(pc + 1)
+			}
+			if len(frames) == 0 {
+				return result, nil
+			}
+			caller := frames[len(frames)-1]
+			frames = frames[:len(frames)-1]
+			index, pc, fp = caller.proc, caller.pc, caller.fp
+			proc = &procs[index]
+			stack[fp+caller.dst] = result
+		}
+	}
+}
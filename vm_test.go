@@ -0,0 +1,147 @@
+package cube
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const vmSource = `
+	func nine(a u64, b u64, c u64, d u64, e u64, f u64, g u64, h u64, i u64) u64 {
+		var r u64
+		entry:
+			sub r, 7, i
+			shl r, r, h
+			ret r
+	}
+
+	func fib(n u64) u64 {
+		var a u64
+		var b u64
+		var m u64
+		entry:
+			jnz n, rec, done
+		rec:
+			sub m, n, 1
+			jnz m, more, done
+		more:
+			call a, fib(m)
+			sub m, m, 1
+			call b, fib(m)
+			add a, a, b
+			ret a
+		done:
+			ret n
+	}
+
+	func big(x u64) u64 {
+		var r u64
+		entry:
+			mul r, x, 0x123456789abcdef
+			add r, 0xffffffff80000000, r
+			call r, nine(r, 0, 0, 0, 0, 0, 0, 3, x)
+			ret r
+	}`
+
+func compileVMSource(t *testing.T, pipeline string) (*Module, *Bytecode) {
+	var mod *Module
+	err := Compile(&Config{
+		Source: vmSource,
+		Module: func(m *Module) error {
+			mod = m
+			return NewPassManager().RunModule(mod, pipeline)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc, err := CompileBytecode(mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mod, bc
+}
+
+func TestVM_Call(t *testing.T) {
+	tests := []struct {
+		name string
+		args []uint64
+	}{
+		{"nine", []uint64{100, 0, 0, 0, 0, 0, 0, 2, 1}},
+		{"fib", []uint64{20}},
+		{"big", []uint64{3}},
+	}
+
+	for _, pipeline := range []string{"-O0", "-O1", "-O2"} {
+		mod, bc := compileVMSource(t, pipeline)
+		vm := NewVM(bc)
+		for _, test := range tests {
+			expected, err := NewInterpreter(mod).Call(test.name, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result, err := vm.Call(test.name, test.args...); err != nil || result != expected {
+				t.Fatal(pipeline, test.name, result, expected, err)
+			}
+		}
+
+		if _, err := vm.Call("fib"); err == nil {
+			t.Fatal("expected an error")
+		} else if _, err := vm.Call("missing"); err == nil {
+			t.Fatal("expected an error")
+		}
+
+		vm.MaxSteps = 100
+		if _, err := vm.Call("fib", 20); err == nil || !strings.Contains(err.Error(), "exceeded 100 steps") {
+			t.Fatal(err)
+		}
+
+		vm.MaxSteps, vm.MaxStack = 0, 16
+		if _, err := vm.Call("fib", 20); err == nil || !strings.Contains(err.Error(), "overflowed the stack of 16 slots") {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBytecode_Serialize(t *testing.T) {
+	_, bc := compileVMSource(t, "-O1")
+
+	var buf bytes.Buffer
+	if _, err := bc.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	loaded, err := ReadBytecode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	} else if result, err := NewVM(loaded).Call("fib", 20); err != nil || result != 6765 {
+		t.Fatal(result, err)
+	}
+
+	if _, err := ReadBytecode(strings.NewReader("func f() u64 {}")); err != ErrNotBytecode {
+		t.Fatal(err)
+	} else if _, err := ReadBytecode(bytes.NewReader(data[:len(data)-1])); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// redirect the first jump of fib outside of the procedure
+	fib := loaded.procs[loaded.lookup("fib")]
+	for pc := fib.offset; ; pc += bytecodeLengths[loaded.code[pc]&0xff] {
+		if op := bytecodeOpcode(loaded.code[pc] & 0xff); op == bytecode_JNZ || op == bytecode_JMP {
+			loaded.code[pc+1] = 0
+			break
+		}
+	}
+	if err := loaded.verify(); err == nil || !strings.Contains(err.Error(), "bad jump target") {
+		t.Fatal(err)
+	}
+
+	// a frame that is too large to allocate
+	crafted, _ := ReadBytecode(bytes.NewReader(data))
+	crafted.procs[crafted.lookup("fib")].framesize = 1 << 31
+	if err := crafted.verify(); err == nil || !strings.Contains(err.Error(), "bad header") {
+		t.Fatal(err)
+	}
+}